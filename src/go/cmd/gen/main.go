@@ -7,64 +7,29 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math/rand"
 	"os"
+	"runtime"
 	"runtime/pprof"
 	"runtime/trace"
 	"sort"
 	"strconv"
-	"strings"
 	"time"
 
 	"golang.org/x/exp/maps"
 )
 
-type Station struct {
-	Target   int
-	ValCount int
-	ValSum   int
-	Vals     []int
-}
-
-const SPREAD = 123
-
-func (s Station) MinMax() (int, int) {
-	return s.Target - SPREAD, s.Target + SPREAD
-}
-
-func (s Station) NaiveValue(rng *rand.Rand) int {
-	return s.Target + (rng.Intn(2*SPREAD+1) - SPREAD)
-}
-
-func (s Station) BiasedValue(rng *rand.Rand, sign, error int) int {
-	rv := 61 + rng.Intn(61)
-	return s.Target + sign*min(rv, sign*error*s.ValCount)
-}
-
 type StationMap = map[string]*Station
 
-func AddValue(cityStation *Station, v int) {
-	cityStation.ValSum += v
-	cityStation.Vals = append(cityStation.Vals, v)
-	cityStation.ValCount++
-}
-
 var (
 	Since_tReadFile     time.Duration
 	Since_tBaseStations time.Duration
 	Since_tSort         time.Duration
 
-	Since_tBulk     time.Duration
-	Since_tBulkPrep time.Duration
-	Since_tBulkInit time.Duration
-	Since_tBulkBulk time.Duration
-
-	Since_tErrAvg time.Duration
-	Since_tErrSum time.Duration
-	Since_tFill   time.Duration
+	Since_tPlan time.Duration
+	Since_tBulk time.Duration
+	Since_tFill time.Duration
 
 	Since_tWriteCheck time.Duration
-	Since_tDerange    time.Duration
 	Since_tOutput     time.Duration
 )
 
@@ -79,8 +44,10 @@ func main() {
 
 	flagN := flag.Int64("n", 1_000_000_000, "rows")
 	flagBulk := flag.Int("bulk", 90, "% bulk")
-	flagSeed := flag.Int64("seed", 0, "rng seed")
+	flagSeed := flag.Int64("seed", 0, "rng seed, the output is the same for the same seed and workers")
+	flagWorkers := flag.Int("workers", runtime.NumCPU(), "goroutines planning and writing the rows")
 	flag.Parse()
+	workers := max(1, *flagWorkers)
 
 	if *flagTrace != "" {
 		f, _ := os.OpenFile(*flagTrace, os.O_CREATE|os.O_TRUNC, 0644)
@@ -102,8 +69,8 @@ func main() {
 		panic(fmt.Errorf("mmap file: %w", err))
 	}
 
-	log.Printf("initializing rng from seed: '%d'", *flagSeed)
-	rng := rand.New(rand.NewSource(*flagSeed))
+	log.Printf("deriving rngs from seed: '%d' for %d workers", *flagSeed, workers)
+	seed := uint64(*flagSeed)
 
 	log.Print("parsing csv from file")
 	csvReader := csv.NewReader(bytes.NewReader(inputBytes))
@@ -132,162 +99,46 @@ func main() {
 			continue
 		}
 
-		stationMap[name] = &Station{Target: int(value * 10)}
+		stationMap[name] = &Station{Name: name, Target: int(value * 10)}
 	}
 	Since_tBaseStations = time.Since(tBaseStations)
 
 	tSort := time.Now()
 	cities := maps.Keys(stationMap)
 	sort.Strings(cities)
-	Since_tSort = time.Since(tSort)
-
-	tBulk := time.Now()
-	tBulkPrep := time.Now()
-	var lines []string = make([]string, 0, *flagN)
-	var nextPrint, printIncrement = 0, *flagN / 100
-	reportGenProgress := func() {
-		if len(lines) >= nextPrint {
-			nextPrint += int(printIncrement)
-			fmt.Print("\rgeneration progress: ", len(lines))
-		}
-	}
-	Since_tBulkPrep = time.Since(tBulkPrep)
-
-	// initial 3
-	tBulkInit := time.Now()
-	log.Print("generating initial min/mean/max")
-	for _, city := range cities {
-		station := stationMap[city]
-		min, max := station.MinMax()
-		vs := []int{min, station.Target, max}
-		for _, v := range vs {
-			AddValue(station, v)
-			lines = append(lines, fmt.Sprintf("%s;%s", city, pkg.PrintIndec(v)))
-		}
-	}
-	Since_tBulkInit = time.Since(tBulkInit)
-
-	// bulk
-	tBulkBulk := time.Now()
-	avgStationCount := int(*flagN) / len(cities)
-	bulkSize := (*flagBulk*avgStationCount)/100 - 3
-	log.Printf("generating initial bulk: bulk=%d avgCount=%d", bulkSize, avgStationCount)
-	if bulkSize > 0 {
-		for _, city := range cities {
-			if len(lines) >= int(*flagN) {
-				break
-			}
-			station := stationMap[city]
-
-			for i := 0; i < bulkSize; i++ {
-				v := station.NaiveValue(rng)
-				AddValue(station, v)
-				lines = append(lines, fmt.Sprintf("%s;%s", city, pkg.PrintIndec(v)))
-				reportGenProgress()
-
-			}
-		}
-		fmt.Println("")
-	}
-	Since_tBulkBulk = time.Since(tBulkBulk)
-	Since_tBulk = time.Since(tBulk)
-
-	tErrAvg := time.Now()
-	log.Printf("fixing avg errors from %d", len(lines))
-	for _, city := range cities {
-		station := stationMap[city]
-		if station.ValCount == 0 {
-			continue
-		}
-		avgError := station.Target - station.ValSum/station.ValCount
-		if avgError == 0 {
-			continue
-		}
-
-		for avgError != 0 {
-			var sign int = 1
-			if avgError < 0 {
-				sign = -1
-			}
-			v := station.BiasedValue(rng, sign, avgError)
-			AddValue(station, v)
-			lines = append(lines, fmt.Sprintf("%s;%s", city, pkg.PrintIndec(v)))
-			reportGenProgress()
-			avgError = station.Target - station.ValSum/station.ValCount
-		}
-	}
-	fmt.Println("")
-	Since_tErrAvg = time.Since(tErrAvg)
-
-	tErrSum := time.Now()
-	log.Printf("improving sum errors from %d", len(lines))
-	const MaxError = SPREAD
-	for _, city := range cities {
-		if len(lines) >= int(*flagN) {
-			break
-		}
-		station := stationMap[city]
-		sumError := station.Target*station.ValCount - station.ValSum
-		var sign int = 1
-		if sumError < 0 {
-			sign = -1
-		}
-
-		if sign*sumError <= MaxError {
-			continue
-		}
-
-		for sign*sumError > MaxError {
-			var sign int = 1
-			if sumError < 0 {
-				sign = -1
-			}
-			v := station.BiasedValue(rng, sign, sumError)
-			AddValue(station, v)
-			lines = append(lines, fmt.Sprintf("%s;%s", city, pkg.PrintIndec(v)))
-			reportGenProgress()
-			sumError = station.Target*station.ValCount - station.ValSum
-			if len(lines) >= int(*flagN) {
-				break
-			}
-		}
-		if len(lines) >= int(*flagN) {
-			break
-		}
+	stations := make([]*Station, len(cities))
+	for i, city := range cities {
+		stations[i] = stationMap[city]
+		stations[i].Index = i
 	}
-	fmt.Println("")
-	Since_tErrSum = time.Since(tErrSum)
+	Since_tSort = time.Since(tSort)
 
-	tFill := time.Now()
-	log.Printf("filling up from %d to %d", len(lines), *flagN)
-	for len(lines) < int(*flagN) {
-		city := cities[rng.Intn(len(cities))]
-		station := stationMap[city]
-		AddValue(station, station.Target)
-		lines = append(lines, fmt.Sprintf("%s;%s", city, pkg.PrintIndec(station.Target)))
-		reportGenProgress()
+	tPlan := time.Now()
+	log.Printf("planning %d rows over %d stations", *flagN, len(stations))
+	rows, sizes := Plan(stations, int(*flagN), *flagBulk, workers, seed)
+	if rows != int(*flagN) {
+		log.Printf("the fixes overshoot -n by %d rows", rows-int(*flagN))
 	}
-	fmt.Println("")
-	Since_tFill = time.Since(tFill)
+	Since_tPlan = time.Since(tPlan)
 
 	tWriteCheck := time.Now()
 	log.Printf("creating check file '%s'", *flagCheck)
-	checkFile, err := os.OpenFile(*flagCheck, os.O_CREATE|os.O_TRUNC, 0644)
+	checkFile, err := os.OpenFile(*flagCheck, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		panic(fmt.Errorf("open check file '%s': %w", *flagCheck, err))
 	}
 
 	log.Print("filling check file")
-	for i, city := range cities {
-		station := stationMap[city]
-		if station.ValCount == 0 {
+	tenth := max(1, len(stations)/10)
+	for i, station := range stations {
+		if station.Count == 0 {
 			continue
 		}
 		min, max := station.MinMax()
-		line := fmt.Sprintf("%s=%s/%s/%s\n", city, pkg.PrintIndec(min), pkg.PrintIndec(station.Target), pkg.PrintIndec(max))
+		line := fmt.Sprintf("%s=%s/%s/%s\n", station.Name, pkg.PrintIndec(min), pkg.PrintIndec(station.Target), pkg.PrintIndec(max))
 		checkFile.WriteString(line)
-		if i%(len(cities)/10) == 0 {
-			fmt.Printf("\rdone: %d0%%", i/(len(cities)/10))
+		if i%tenth == 0 {
+			fmt.Printf("\rdone: %d0%%", i/tenth)
 		}
 	}
 	checkFile.Close()
@@ -295,34 +146,22 @@ func main() {
 	Since_tWriteCheck = time.Since(tWriteCheck)
 
 	if *flagFile != "" {
-		tDerange := time.Now()
-		log.Print("randomizing lines")
-		randomIndices := derange(rng, int(*flagN))
-		var sb strings.Builder
-		for j, i := range randomIndices {
-			line := lines[i]
-			sb.WriteString(line)
-			sb.WriteByte('\n')
-			if j%(int(*flagN/100)) == 0 {
-				fmt.Printf("\rdone: %d%%", j/(int(*flagN/100)))
-			}
-		}
-		Since_tDerange = time.Since(tDerange)
-
 		tOutput := time.Now()
 		log.Printf("creating output file '%s'", *flagFile)
-		outputFile, err := os.OpenFile(*flagFile, os.O_CREATE|os.O_TRUNC, 0644)
+		outputFile, err := os.OpenFile(*flagFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 		if err != nil {
 			panic(fmt.Errorf("open output file '%s': %w", *flagFile, err))
 		}
 
-		log.Print("writing file")
-		n, err := outputFile.WriteString(sb.String())
+		log.Print("writing shuffled rows")
+		n, err := WriteRows(outputFile, stations, sizes, seed)
 		if err != nil {
 			panic(fmt.Errorf("write output file: %w", err))
 		}
-		outputFile.Close()
-		log.Printf("Test data build complete. wrote %d bytes in %d lines\n", n, len(lines))
+		if err := outputFile.Close(); err != nil {
+			panic(fmt.Errorf("close output file: %w", err))
+		}
+		log.Printf("Test data build complete. wrote %d bytes in %d lines\n", n, rows)
 		Since_tOutput = time.Since(tOutput)
 	}
 
@@ -330,58 +169,21 @@ func main() {
 [ ReadFile: %v
 [ BaseStations: %v
 [ Sort: %v
-[ Bulk: %v
-  > BulkPrep: %v
-  > BulkInit: %v
-  > BulkBulk: %v
-[ ErrAvg: %v
-[ ErrSum: %v
-[ Fill: %v
+[ Plan: %v
+  > Bulk: %v
+  > Fill: %v
 [ WriteCheck: %v
-[ Derange: %v
 [ Output: %v
 = Total: %v
 			 `,
 		Since_tReadFile,
 		Since_tBaseStations,
 		Since_tSort,
+		Since_tPlan,
 		Since_tBulk,
-		Since_tBulkPrep,
-		Since_tBulkInit,
-		Since_tBulkBulk,
-		Since_tErrAvg,
-		Since_tErrSum,
 		Since_tFill,
 		Since_tWriteCheck,
-		Since_tDerange,
 		Since_tOutput,
 		time.Since(tTotal),
 	)
 }
-
-func derange(rng *rand.Rand, n int) []int {
-	arr := make([]int, n)
-	for i := range n {
-		arr[i] = i
-	}
-
-	for i := n - 1; i > 0; i-- {
-		j := rng.Intn(i + 1)
-		for j == i {
-			j = rng.Intn(i + 1)
-		}
-		arr[i], arr[j] = arr[j], arr[i]
-	}
-
-	for i, val := range arr {
-		if i == val {
-			if i == 0 {
-				arr[i], arr[i+1] = arr[i+1], arr[i]
-			} else {
-				arr[i], arr[i-1] = arr[i-1], arr[i]
-			}
-		}
-	}
-
-	return arr
-}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"brc/pkg"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RNG_STATION = iota + 1 // the bulk values of a station in a shard
+	RNG_FILL               // the stations of a share of the fill rows
+	RNG_SHARD              // the row order of an output shard
+	RNG_ORDER              // the order of the values of a station in a shard
+)
+
+// newPCG returns rng stream i of a domain, all derived from seed and distinct across domains.
+func newPCG(seed uint64, domain, i int) *rand.PCG {
+	return rand.NewPCG(seed, uint64(domain)<<56|uint64(i))
+}
+
+// parallel calls fn for every i in [0, n) on up to workers goroutines.
+func parallel(workers, n int, fn func(i int)) {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(workers, n) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < n; i = int(next.Add(1) - 1) {
+				fn(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type Station struct {
+	Name   string
+	Index  int // in the sorted stations, selects the station's rng streams
+	Target int
+
+	// the plan, in phases: min, Target and max, Bulk naive values, Fixes values that add up to Deficit more than
+	// Target each, and Fill values of Target. The values sum up to exactly Target*Count, so the mean is Target
+	// whatever the rounding. Every phase is split over the shards of the output, see share, and a shard
+	// generates its part in random order, see Values.Next.
+	Bulk    int
+	Fixes   int
+	Deficit int // Target*(3+Bulk) minus the sum of the values before the fixes
+	Fill    int
+
+	Count int
+}
+
+const SPREAD = 123
+
+// the phases of a plan, see Station
+const (
+	PHASE_MIN = iota
+	PHASE_TARGET
+	PHASE_MAX
+	PHASE_BULK
+	PHASE_FIX
+	PHASE_FILL
+	PHASES
+)
+
+// phases returns the number of values in each phase of s.
+func (s *Station) phases() [PHASES]int {
+	return [PHASES]int{1, 1, 1, s.Bulk, s.Fixes, s.Fill}
+}
+
+// share returns the values of a phase of c values, by index, in shard k of n.
+func share(c, k, n int) (from, to int) {
+	return c * k / n, c * (k + 1) / n
+}
+
+func (s *Station) MinMax() (int, int) {
+	return s.Target - SPREAD, s.Target + SPREAD
+}
+
+func (s *Station) NaiveValue(rng *rand.Rand) int {
+	return s.Target + (rng.IntN(2*SPREAD+1) - SPREAD)
+}
+
+// FixValue returns fix j of s: Deficit is spread as evenly as integers allow over the Fixes, so each is within
+// SPREAD of Target and they add up to Deficit exactly.
+func (s *Station) FixValue(j int) int {
+	return s.Target + (j+1)*s.Deficit/s.Fixes - j*s.Deficit/s.Fixes
+}
+
+// value returns value j of a phase other than the bulk.
+func (s *Station) value(phase, j int) int {
+	min, max := s.MinMax()
+	switch phase {
+	case PHASE_MIN:
+		return min
+	case PHASE_MAX:
+		return max
+	case PHASE_FIX:
+		return s.FixValue(j)
+	}
+	return s.Target
+}
+
+// planFixes sets the fixes making up for the sum of the values before them, the fewest that stay within SPREAD.
+func (s *Station) planFixes(sum int) {
+	s.Deficit = s.Target*(3+s.Bulk) - sum
+	s.Fixes = (max(s.Deficit, -s.Deficit) + SPREAD - 1) / SPREAD
+}
+
+// bulkRng returns the rng of the bulk values of s in shard k of n.
+func (s *Station) bulkRng(seed uint64, k, n int) *rand.Rand {
+	return rand.New(newPCG(seed, RNG_STATION, s.Index*n+k))
+}
+
+// Values returns the values of s in shard k of n, generated with the shard's rng streams of seed.
+func (s *Station) Values(seed uint64, k, n int) *Values {
+	vs := &Values{s: s, rng: s.bulkRng(seed, k, n), order: rand.New(newPCG(seed, RNG_ORDER, s.Index*n+k))}
+	for phase, c := range s.phases() {
+		from, to := share(c, k, n)
+		vs.byPhase[phase] = to - from
+		vs.Left += to - from
+		if phase == PHASE_FIX {
+			vs.fix = from
+		}
+	}
+	return vs
+}
+
+// Values generates the values of a station in a shard one at a time, so rows can be written in any order
+// without keeping them. Generating them again with the same seed and shards yields the same values.
+type Values struct {
+	s       *Station
+	byPhase [PHASES]int // values left to generate
+	Left    int         // of all phases
+	fix     int         // the next fix
+	rng     *rand.Rand  // of the bulk values
+	order   *rand.Rand  // of the phase of every value
+}
+
+// Next returns the next value, it is called at most Left times. Its phase is drawn in proportion to the values
+// every phase has left, so the phases are shuffled without keeping the values. The bulk values are generated
+// in the order Plan summed them up, whatever the phases drawn.
+func (vs *Values) Next() int {
+	r := vs.order.IntN(vs.Left)
+	phase := 0
+	for ; r >= vs.byPhase[phase]; phase++ {
+		r -= vs.byPhase[phase]
+	}
+	vs.byPhase[phase]--
+	vs.Left--
+
+	switch phase {
+	case PHASE_BULK:
+		return vs.s.NaiveValue(vs.rng)
+	case PHASE_FIX:
+		vs.fix++
+		return vs.s.value(phase, vs.fix-1)
+	}
+	return vs.s.value(phase, 0)
+}
+
+// rowSize returns the bytes of a row of s with value v.
+func (s *Station) rowSize(v int) int64 {
+	var buf [8]byte
+	return int64(len(s.Name) + len(pkg.AppendIndec(buf[:0], v)) + 2) // ';' and '\n'
+}
+
+// Plan plans n rows over the sorted stations: the initial min, mean and max of each, bulk% of the rows as naive
+// values, the fixes, then rows of Target at random stations. Only the counts and deficits are kept, planning is
+// O(n) without any search. The fixes can overshoot n for small n. The stations are planned on workers goroutines,
+// the fill rows in workers shares with their own rng, so a plan only depends on seed and workers.
+// It returns the bytes of each of the workers shards WriteRows writes the rows in.
+func Plan(stations []*Station, n, bulk, workers int, seed uint64) (rows int, sizes []int64) {
+	avgStationCount := n / len(stations)
+	bulkSize := (bulk*avgStationCount)/100 - 3
+	shardSizes := make([]atomic.Int64, workers)
+
+	tBulk := time.Now()
+	rows = 3 * len(stations)
+	for _, s := range stations {
+		if bulkSize > 0 && rows < n {
+			s.Bulk = bulkSize
+			rows += s.Bulk
+		}
+	}
+	parallel(workers, len(stations), func(i int) {
+		s := stations[i]
+		min, max := s.MinMax()
+		sum := min + s.Target + max
+		for k := range workers {
+			rng := s.bulkRng(seed, k, workers)
+			from, to := share(s.Bulk, k, workers)
+			var size int64
+			for range to - from {
+				v := s.NaiveValue(rng)
+				sum += v
+				size += s.rowSize(v)
+			}
+			shardSizes[k].Add(size)
+		}
+		s.planFixes(sum)
+	})
+	for _, s := range stations {
+		rows += s.Fixes
+	}
+	Since_tBulk = time.Since(tBulk)
+
+	tFill := time.Now()
+	fill := max(0, n-rows)
+	fills := make([][]int, workers)
+	parallel(workers, workers, func(k int) {
+		rng := rand.New(newPCG(seed, RNG_FILL, k))
+		fills[k] = make([]int, len(stations))
+		for range fill*(k+1)/workers - fill*k/workers {
+			fills[k][rng.IntN(len(stations))]++
+		}
+	})
+	for i, s := range stations {
+		for k := range fills {
+			s.Fill += fills[k][i]
+		}
+		s.Count = 3 + s.Bulk + s.Fixes + s.Fill
+		rows += s.Fill
+	}
+	Since_tFill = time.Since(tFill)
+
+	// the bulk is sized, the other values are known without an rng
+	parallel(workers, len(stations), func(i int) {
+		s := stations[i]
+		for k := range workers {
+			var size int64
+			for phase, c := range s.phases() {
+				from, to := share(c, k, workers)
+				switch phase {
+				case PHASE_BULK:
+				case PHASE_FIX:
+					for j := from; j < to; j++ {
+						size += s.rowSize(s.value(phase, j))
+					}
+				default:
+					size += int64(to-from) * s.rowSize(s.value(phase, 0))
+				}
+			}
+			shardSizes[k].Add(size)
+		}
+	})
+	sizes = make([]int64, workers)
+	for k := range sizes {
+		sizes[k] = shardSizes[k].Load()
+	}
+	return rows, sizes
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+// TestPlanSums checks that the values of every station, over all the shards, are Count values within SPREAD of
+// Target that add up to exactly Target*Count.
+func TestPlanSums(t *testing.T) {
+	for _, workers := range []int{1, 3, 8} {
+		stations := testStations(50)
+		rows, _ := Plan(stations, 20_000, 90, workers, 42)
+		total := 0
+		for _, s := range stations {
+			min, max := s.MinMax()
+			count, sum := 0, 0
+			for k := range workers {
+				for vs := s.Values(42, k, workers); vs.Left > 0; {
+					v := vs.Next()
+					if v < min || v > max {
+						t.Fatalf("%d workers: '%s' has %d, outside [%d, %d]", workers, s.Name, v, min, max)
+					}
+					count++
+					sum += v
+				}
+			}
+			if count != s.Count || sum != s.Target*s.Count {
+				t.Errorf("%d workers: '%s' has %d values summing up to %d, want %d and %d", workers, s.Name, count, sum, s.Count, s.Target*s.Count)
+			}
+			total += count
+		}
+		if total != rows {
+			t.Errorf("%d workers: %d values, Plan planned %d rows", workers, total, rows)
+		}
+	}
+}
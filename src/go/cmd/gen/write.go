@@ -0,0 +1,127 @@
+package main
+
+import (
+	"brc/pkg"
+	"bufio"
+	"fmt"
+	"io"
+	"math/bits"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	WRITE_BUF      = 1 << 20
+	PROGRESS_ROWS  = 1 << 16 // rows a shard writes between progress updates
+	PROGRESS_EVERY = time.Second
+)
+
+// picker draws stations with a probability proportional to their remaining rows, a Fenwick tree over the counts.
+type picker struct {
+	tree      []int // 1 based
+	remaining int
+}
+
+func newPicker(counts []int) *picker {
+	p := &picker{tree: make([]int, len(counts)+1)}
+	for i, c := range counts {
+		p.tree[i+1] += c
+		if j := i + 1 + (i+1)&-(i+1); j < len(p.tree) {
+			p.tree[j] += p.tree[i+1]
+		}
+		p.remaining += c
+	}
+	return p
+}
+
+// pick draws a station and takes one of its rows.
+func (p *picker) pick(rng *rand.Rand) int {
+	r := rng.IntN(p.remaining)
+	i := 0
+	for step := 1 << (bits.Len(uint(len(p.tree)-1)) - 1); step > 0; step >>= 1 {
+		if j := i + step; j < len(p.tree) && p.tree[j] <= r {
+			i = j
+			r -= p.tree[j]
+		}
+	}
+	for j := i + 1; j < len(p.tree); j += j & -j {
+		p.tree[j]--
+	}
+	p.remaining--
+	return i
+}
+
+// WriteRows writes the planned rows of stations to w in shuffled order, in shards of the sizes Plan returned written
+// in parallel at their offsets. In a shard every row draws its station by the rows it has left in the shard, with
+// the shard's rng, and takes the station's next value. Memory is bounded by stations and shards, whatever the
+// rows, and the output only depends on seed and the number of shards.
+func WriteRows(w io.WriterAt, stations []*Station, sizes []int64, seed uint64) (n int64, err error) {
+	var rows, written atomic.Int64
+	for _, s := range stations {
+		rows.Add(int64(s.Count))
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(PROGRESS_EVERY)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fmt.Printf("\rdone: %d%%", written.Load()*100/max(1, rows.Load()))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var g errgroup.Group
+	var offset int64
+	for k := range sizes {
+		ow := io.NewOffsetWriter(w, offset)
+		offset += sizes[k]
+		g.Go(func() error {
+			n, err := writeShard(ow, stations, k, len(sizes), seed, &written)
+			if err == nil && n != sizes[k] {
+				err = fmt.Errorf("shard %d: wrote %d bytes, planned %d", k, n, sizes[k])
+			}
+			return err
+		})
+	}
+	err = g.Wait()
+	fmt.Println("")
+	return offset, err
+}
+
+// writeShard writes shard k of shards, adding the rows it wrote to written as it goes.
+func writeShard(w io.Writer, stations []*Station, k, shards int, seed uint64, written *atomic.Int64) (n int64, err error) {
+	counts := make([]int, len(stations))
+	values := make([]*Values, len(stations))
+	for i, s := range stations {
+		values[i] = s.Values(seed, k, shards)
+		counts[i] = values[i].Left
+	}
+	p := newPicker(counts)
+	rng := rand.New(newPCG(seed, RNG_SHARD, k))
+
+	bw := bufio.NewWriterSize(w, WRITE_BUF)
+	var line []byte
+	for j := 1; p.remaining > 0; j++ {
+		i := p.pick(rng)
+		line = append(line[:0], stations[i].Name...)
+		line = append(line, ';')
+		line = pkg.AppendIndec(line, values[i].Next())
+		line = append(line, '\n')
+		if _, err := bw.Write(line); err != nil {
+			return n, err
+		}
+		n += int64(len(line))
+		if j%PROGRESS_ROWS == 0 {
+			written.Add(PROGRESS_ROWS)
+		}
+	}
+	return n, bw.Flush()
+}
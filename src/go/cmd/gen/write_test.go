@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// testStations returns n stations with targets on both sides of zero, indexed like sorted ones.
+func testStations(n int) []*Station {
+	stations := make([]*Station, n)
+	for i := range stations {
+		stations[i] = &Station{Name: fmt.Sprintf("Station %03d", i), Index: i, Target: i*37%600 - 300}
+	}
+	return stations
+}
+
+// writeFile plans and writes n rows of stations with seed on workers goroutines and returns the file.
+func writeFile(t *testing.T, stations []*Station, n, workers int, seed uint64) []byte {
+	t.Helper()
+	_, sizes := Plan(stations, n, 90, workers, seed)
+	f, err := os.Create(filepath.Join(t.TempDir(), "measurements.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := WriteRows(f, stations, sizes, seed); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestWriteRows checks that the output only depends on the seed and workers, and that the rows of every station
+// in it are Count values adding up to Target*Count.
+func TestWriteRows(t *testing.T) {
+	a := writeFile(t, testStations(50), 20_000, 4, 7)
+	if b := writeFile(t, testStations(50), 20_000, 4, 7); !bytes.Equal(a, b) {
+		t.Fatal("the same seed and workers gave different outputs")
+	}
+	if c := writeFile(t, testStations(50), 20_000, 4, 8); bytes.Equal(a, c) {
+		t.Error("another seed gave the same output")
+	}
+
+	for _, workers := range []int{1, 5} {
+		stations := testStations(50)
+		data := writeFile(t, stations, 20_000, workers, 7)
+		counts, sums := map[string]int{}, map[string]int{}
+		for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'}) {
+			name, value, ok := bytes.Cut(line, []byte{';'})
+			v, err := strconv.ParseFloat(string(value), 64)
+			if !ok || err != nil {
+				t.Fatalf("%d workers: malformed row '%s'", workers, line)
+			}
+			counts[string(name)]++
+			sums[string(name)] += int(math.Round(v * 10))
+		}
+		for _, s := range stations {
+			if counts[s.Name] != s.Count || sums[s.Name] != s.Target*s.Count {
+				t.Errorf("%d workers: '%s' has %d rows summing up to %d, want %d and %d", workers, s.Name, counts[s.Name], sums[s.Name], s.Count, s.Target*s.Count)
+			}
+		}
+	}
+}
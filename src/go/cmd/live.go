@@ -0,0 +1,310 @@
+package main
+
+import (
+	"brc/pkg"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	LIVE_READ_BUF = 64 * 1024
+	LIVE_BATCH    = LIVE_READ_BUF / 8
+)
+
+// liveShard owns the stations whose hash falls into it, snapshots only block writers of one shard at a time.
+// Its stations are in open with -table open, in output otherwise.
+type liveShard struct {
+	sync.RWMutex
+	output OutputMap
+	open   *pkg.CityMap
+}
+
+type liveState struct {
+	cfg    Config // parser, hash, table and the Interner all shards share, the pipeline fields do not apply
+	shards []liveShard
+	rows   atomic.Int64
+	conns  atomic.Int64
+}
+
+// Live implements the 'live' command: measurement lines are ingested from a TCP or unix socket into
+// sharded CityData maps, and the running aggregate can be queried over HTTP at any time.
+func Live(args []string) {
+	flags := flag.NewFlagSet("live", flag.ExitOnError)
+	flagListen := flags.String("listen", "tcp://:9000", "ingestion socket: tcp://<host:port> or unix://<path>")
+	flagHTTP := flags.String("http", ":8081", "query address serving 'GET /aggregate'")
+	flagShards := flags.Int("shards", pkg.DefaultConfig(0).Workers, "number of independently locked map shards")
+	flagSnapshot := flags.String("snapshot", "", "file the final snapshot is written to on shutdown")
+	flagFormat := flags.String("format", FORMAT_TEXT, "final snapshot format: text|json|partial")
+	flagOrder := OrderFlags(flags)
+	flagConfig := ConfigFlags(flags)
+	flags.Parse(args)
+	if !ValidFormat(*flagFormat) {
+		log.Fatalf("unknown format: '%s'", *flagFormat)
+	}
+	order, err := flagOrder()
+	if err != nil {
+		log.Fatal(err)
+	}
+	override, err := flagConfig.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg, err := prepareRun(pkg.DefaultConfig(0).Override(override), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Table == pkg.TABLE_COLUMNS {
+		log.Fatalf("live: table '%s' is not supported, use %s or %s", cfg.Table, pkg.TABLE_MAP, pkg.TABLE_OPEN)
+	}
+
+	network, address, ok := strings.Cut(*flagListen, "://")
+	if !ok || (network != "tcp" && network != "unix") {
+		log.Fatalf("listen '%s': want tcp://<host:port> or unix://<path>", *flagListen)
+	}
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ls := &liveState{cfg: cfg, shards: make([]liveShard, max(1, *flagShards))}
+	for i := range ls.shards {
+		if cfg.Table == pkg.TABLE_OPEN {
+			ls.shards[i].open = pkg.NewCityMap(cfg.MapSize/len(ls.shards), cfg.Interner)
+		} else {
+			ls.shards[i].output = make(OutputMap, cfg.MapSize/len(ls.shards))
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /aggregate", ls.GetAggregate)
+	httpServer := &http.Server{Addr: *flagHTTP, Handler: mux}
+	go func() {
+		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	conns := map[net.Conn]struct{}{}
+	go func() {
+		<-ctx.Done()
+		log.Print("shutting down, no longer accepting connections")
+		ln.Close()
+		mu.Lock()
+		for conn := range conns {
+			closeRead(conn)
+		}
+		mu.Unlock()
+	}()
+
+	log.Printf("ingesting on '%s', serving on '%s'", *flagListen, *flagHTTP)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Print(err)
+			}
+			break
+		}
+		mu.Lock()
+		conns[conn] = struct{}{}
+		if ctx.Err() != nil {
+			// accepted while shutting down, possibly after the connections were closed for reading
+			closeRead(conn)
+		}
+		mu.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls.Ingest(conn)
+			mu.Lock()
+			delete(conns, conn)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	httpServer.Shutdown(shutdownCtx)
+
+	if *flagSnapshot != "" {
+		f, err := os.Create(*flagSnapshot)
+		if err != nil {
+			log.Fatal(err)
+		}
+		output := ls.Snapshot()
+		if err := PrintOutput(f, output, PrintOptions{Format: *flagFormat, Order: order}, &Timings{}); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("wrote final snapshot of %d stations to '%s'", len(output), *flagSnapshot)
+	}
+	log.Printf("ingested %d rows", ls.rows.Load())
+	if cfg.Normalizer != nil {
+		merged, rows := cfg.Normalizer.Merged(SortOutput(ls.Snapshot(), &Timings{}))
+		log.Printf("normalize %s: merged %d spellings, rewrote %d rows", cfg.Normalize, merged, rows)
+	}
+}
+
+// closeRead stops reading from conn but lets the lines already received be ingested.
+func closeRead(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	} else {
+		conn.Close()
+	}
+}
+
+// Ingest parses the lines of conn into the shards until it is closed.
+// Buffers are reused, so keys are copied when a station is first seen.
+func (ls *liveState) Ingest(conn net.Conn) {
+	defer conn.Close()
+	ls.conns.Add(1)
+	defer ls.conns.Add(-1)
+
+	parser, names, err := newParser(ls.cfg)
+	if err != nil {
+		log.Printf("%s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	buf := make([]byte, LIVE_READ_BUF)
+	batch := make(Batch, 0, LIVE_BATCH)
+	var n int
+	for {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			if n > 0 && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Printf("%s: %v", conn.RemoteAddr(), err)
+			}
+			if n > 0 {
+				if buf[n-1] != '\n' {
+					buf = append(buf[:n], '\n')
+					n++
+				}
+				ls.parse(conn, parser, names, buf[:n], batch)
+			}
+			return
+		}
+
+		last := bytes.LastIndexByte(buf[:n], '\n')
+		if last < 0 {
+			if n == len(buf) {
+				log.Printf("%s: line longer than %d bytes", conn.RemoteAddr(), len(buf))
+				return
+			}
+			continue
+		}
+		if !ls.parse(conn, parser, names, buf[:last+1], batch) {
+			return
+		}
+		n = copy(buf, buf[last+1:n])
+	}
+}
+
+// parse feeds a line aligned block through parser into the shards, malformed input ends the connection.
+func (ls *liveState) parse(conn net.Conn, parser pkg.Parser, names *pkg.NameCache, block []byte, batch Batch) bool {
+	for len(block) > 0 {
+		var n int
+		var err error
+		batch, n, err = parseBlock(parser, names, block, batch[:0], 0)
+		if err != nil {
+			log.Printf("%s: malformed input: %v", conn.RemoteAddr(), err)
+			return false
+		}
+		block = block[n:]
+		ls.apply(batch)
+	}
+	return true
+}
+
+// apply merges a batch shard by shard, taking each shard's lock once.
+func (ls *liveState) apply(batch Batch) {
+	nShards := uint(len(ls.shards))
+	for i := range ls.shards {
+		shard := &ls.shards[i]
+		shard.Lock()
+		for _, hkv := range batch {
+			if hkv.Hash%nShards != uint(i) {
+				continue
+			}
+			if shard.open != nil {
+				shard.open.Add(&hkv.HK, hkv.Value)
+				continue
+			}
+			val := hkv.Value
+			data := lookup(shard.output, &hkv.HK)
+			if data == nil {
+				hk := HK{Hash: hkv.Hash, Key: ls.cfg.Interner.Intern(hkv.Hash, hkv.Key), Window: hkv.Window}
+				insert(shard.output, &CityData{Min: val, Sum: val, Max: val, Count: 1, HK: hk})
+				continue
+			}
+			data.Min = min(data.Min, val)
+			data.Max = max(data.Max, val)
+			data.Sum += val
+			data.Count++
+		}
+		shard.Unlock()
+	}
+	ls.rows.Add(int64(len(batch)))
+}
+
+// Snapshot copies the current aggregate, ingestion continues while it runs.
+func (ls *liveState) Snapshot() OutputMap {
+	output := make(OutputMap, pkg.STATIONS)
+	for i := range ls.shards {
+		shard := &ls.shards[i]
+		shard.RLock()
+		copyStation := func(cd *CityData) {
+			data := *cd
+			insert(output, &data)
+		}
+		if shard.open != nil {
+			shard.open.Each(copyStation)
+		} else {
+			each(shard.output, copyStation)
+		}
+		shard.RUnlock()
+	}
+	return output
+}
+
+func (ls *liveState) GetAggregate(w http.ResponseWriter, r *http.Request) {
+	format, ok := acceptFormat(r.Header.Get("Accept"))
+	if !ok {
+		http.Error(w, "supported: text/plain, application/json, text/x-1brc-partial", http.StatusNotAcceptable)
+		return
+	}
+	order, err := ParseOrder(r.URL.Query().Get("sort"), r.URL.Query().Get("sort-by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	output := ls.Snapshot()
+	w.Header().Set("X-Rows", fmt.Sprint(ls.rows.Load()))
+	w.Header().Set("X-Connections", fmt.Sprint(ls.conns.Load()))
+	w.Header().Set("Content-Type", ContentType(format))
+	PrintOutput(w, output, PrintOptions{Format: format, Order: order}, &Timings{})
+}
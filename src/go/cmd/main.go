@@ -2,33 +2,39 @@ package main
 
 import (
 	"brc/pkg"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"runtime/trace"
-	"sort"
+	"slices"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/zeebo/xxh3"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
-	CHANS    = 11
-	READ_BUF = 1024 * 1024 * 16
-
-	BLOCK_CHAN_BUF = 64 + 32
-	BATCH_CHAN_BUF = 10
-
-	HKV_BATCH = READ_BUF / 16
-
-	MAP_SIZE = 41_343
+	FORMAT_TEXT    = "text"
+	FORMAT_PARTIAL = "partial"
+	FORMAT_JSON    = "json"
 )
 
+// FUSED_BATCH is the row count of the scratch batch of a FuseBlocks worker, small enough to stay in cache.
+const FUSED_BATCH = 1024
+
 type BlockChan = chan []byte
+type Config = pkg.Config
 type Timings = pkg.Timings
 type CityData = pkg.CityData
 type HashKey = pkg.HashKey
@@ -36,9 +42,72 @@ type HKV = pkg.HKV
 type Batch = []HKV
 type HK = pkg.HK
 
+// OutputMap holds the stations by hash, those sharing a hash are chained through CityData.Next.
+// Use lookup, insert and each rather than indexing it, so colliding stations stay apart.
 type OutputMap = map[HashKey]*CityData
 
+// Stations is an aggregate sorted by window and name, as printed.
+type Stations = []*CityData
+
+// Partial is what a MapData or FuseBlocks worker hands to MergeMaps: an OutputMap, and with TABLE_COLUMNS
+// the Columns holding all stations the PerfectMap, if any, did not.
+type Partial struct {
+	Output  OutputMap
+	Columns *pkg.Columns
+}
+
+// Errors are wrapped in one of these so Fail can map them to an exit code.
+var (
+	ErrUsage  = errors.New("usage")
+	ErrIO     = errors.New("i/o")
+	ErrParse  = errors.New("parse")
+	ErrOutput = errors.New("output")
+)
+
+const (
+	EXIT_STOPPED = 1 // timeout or interrupt
+	EXIT_USAGE   = 2
+	EXIT_IO      = 3
+	EXIT_PARSE   = 4
+	EXIT_OUTPUT  = 5
+)
+
+// Fail logs err and returns the exit code of its kind.
+func Fail(err error) int {
+	log.Printf("error: %v", err)
+	switch {
+	case errors.Is(err, ErrUsage):
+		return EXIT_USAGE
+	case errors.Is(err, ErrIO):
+		return EXIT_IO
+	case errors.Is(err, ErrParse):
+		return EXIT_PARSE
+	case errors.Is(err, ErrOutput):
+		return EXIT_OUTPUT
+	}
+	return EXIT_STOPPED
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "merge":
+			os.Exit(MergeFiles(os.Args[2:]))
+		case "serve":
+			Serve(os.Args[2:])
+			return
+		case "live":
+			Live(os.Args[2:])
+			return
+		case "tune":
+			os.Exit(Tune(os.Args[2:]))
+		}
+	}
+	os.Exit(run())
+}
+
+// run processes a file as configured by the command line flags and returns the exit code.
+func run() int {
 	t := &pkg.Timings{Start: time.Now(), ChanEvent: make(chan pkg.TEvent, 1024*16)}
 	t.SendEvent(time.Now(), "Start")
 
@@ -46,220 +115,343 @@ func main() {
 	flagTrace := flag.String("trace", "", "write trace to file")
 
 	flagFile := flag.String("file", "../../data/measurements.txt", "1brc file")
+	flagFormat := flag.String("format", FORMAT_TEXT, "output format: text|json|partial (partial outputs can be combined with 'merge')")
 
 	flagPercent := flag.Int("percent", 100, "% of file to process [0, 100]")
+	flagOffset := flag.Int64("offset", 0, "byte offset to start at, snapped back to a line start")
+	flagLength := flag.Int64("length", 0, "bytes to process from offset, snapped back to a line start (0 = to end of file)")
+	flagShard := flag.String("shard", "", "process shard i/n of the file (0 <= i < n), overrides offset/length")
+	flagWindow := flag.String("window", "", "aggregate '<Name>;<Temp>;<Timestamp>' rows per tumbling window, e.g. 1h or 1d")
+
+	flagTimeout := flag.Duration("timeout", 0, "stop processing after this long (0 = no timeout)")
+	flagPrintPartial := flag.Bool("print-partial", false, "print the results gathered so far on timeout or interrupt")
+	flagOrder := OrderFlags(flag.CommandLine)
+	flagConfig := ConfigFlags(flag.CommandLine)
 	flag.Parse()
 
+	if !ValidFormat(*flagFormat) {
+		return Fail(fmt.Errorf("%w: unknown format '%s'", ErrUsage, *flagFormat))
+	}
+	order, err := flagOrder()
+	if err != nil {
+		return Fail(fmt.Errorf("%w: %w", ErrUsage, err))
+	}
+	override, err := flagConfig.Load()
+	if err != nil {
+		return Fail(fmt.Errorf("%w: %w", ErrUsage, err))
+	}
+	var window time.Duration
+	if *flagWindow != "" {
+		var err error
+		if window, err = pkg.ParseWindow(*flagWindow); err != nil {
+			return Fail(fmt.Errorf("%w: %w", ErrUsage, err))
+		}
+	}
+
 	if *flagTrace != "" {
-		f, _ := os.OpenFile(*flagTrace, os.O_CREATE|os.O_TRUNC, 0644)
-		trace.Start(f)
+		f, err := os.Create(*flagTrace)
+		if err != nil {
+			return Fail(fmt.Errorf("%w: %w", ErrIO, err))
+		}
 		defer f.Close()
+		if err := trace.Start(f); err != nil {
+			return Fail(fmt.Errorf("%w: start trace: %w", ErrIO, err))
+		}
 		defer trace.Stop()
 	}
 	if *flagProf != "" {
 		f, err := os.Create(*flagProf)
 		if err != nil {
-			log.Fatal(err)
+			return Fail(fmt.Errorf("%w: %w", ErrIO, err))
+		}
+		defer f.Close()
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return Fail(fmt.Errorf("%w: start cpu profile: %w", ErrIO, err))
 		}
-		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 	t.Since_Setup = time.Since(t.Start)
 	t.SendEvent(time.Now(), "Setup: Done")
 
-	tReadFile := time.Now()
-	chanChanBlock := make(chan BlockChan, CHANS)
-	chanBlocks := make([]BlockChan, CHANS)
-	t.SendEvent(time.Now(), "ReadFile: Start")
 	data, size, err := pkg.MMapFile(*flagFile)
 	if err != nil {
-		panic(err)
+		return Fail(fmt.Errorf("%w: %w", ErrIO, err))
 	}
-	var limit int64 = int64(*flagPercent) * size / 100
-	var chanIndex int
-	for off := int64(0); off < limit; {
-		buf := data[off:min(size, off+READ_BUF)]
-		var n int
-		for n = len(buf) - 1; n >= 0; n-- {
-			if buf[n] == '\n' {
-				break
-			}
+
+	to := size
+	if *flagLength > 0 {
+		to = *flagOffset + *flagLength
+	}
+	start, end := pkg.LineRange(data, *flagOffset, to)
+	if *flagShard != "" {
+		i, n, err := ParseShard(*flagShard)
+		if err != nil {
+			return Fail(fmt.Errorf("%w: %w", ErrUsage, err))
+		}
+		start, end = pkg.ShardRange(data, i, n)
+	}
+	end = pkg.SnapLine(data, start+int64(*flagPercent)*(end-start)/100)
+	cfg := pkg.DefaultConfig(end - start).Override(override)
+	t.Workers = cfg.Workers
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *flagTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *flagTimeout)
+		defer cancel()
+	}
+
+	output, err := Aggregate(ctx, cfg, data[start:end], window, t)
+	if err != nil {
+		return Fail(err)
+	}
+
+	exitCode := 0
+	if err := ctx.Err(); err != nil {
+		log.Printf("stopped early: %v", context.Cause(ctx))
+		exitCode = EXIT_STOPPED
+		if !*flagPrintPartial {
+			return exitCode
 		}
-		if n <= 0 {
-			break
+		log.Printf("printing partial results of %d stations", len(output))
+	}
+
+	t.SendEvent(time.Now(), "Print")
+	if err := PrintStations(os.Stdout, output, PrintOptions{Format: *flagFormat, Windowed: window > 0, Order: order}, t); err != nil {
+		return Fail(err)
+	}
+	t.Report()
+	return exitCode
+}
+
+// ConfigOverride is a config file and the single field flags, applied in that order over DefaultConfig.
+type ConfigOverride struct {
+	File string
+	Config
+}
+
+// Load reads the config file, if any, and applies the field flags over it.
+func (o *ConfigOverride) Load() (Config, error) {
+	cfg := o.Config
+	if o.File != "" {
+		c, err := pkg.LoadConfig(o.File)
+		if err != nil {
+			return c, err
 		}
-		n++
-		off += int64(n)
-		t.SendBlocks = time.Now()
-		if chanBlocks[chanIndex] == nil {
-			chanBlocks[chanIndex] = make(BlockChan, BLOCK_CHAN_BUF)
-			chanChanBlock <- chanBlocks[chanIndex]
+		cfg = c.Override(o.Config)
+	}
+	if cfg.Table != "" && cfg.Table != pkg.TABLE_MAP && cfg.Table != pkg.TABLE_OPEN && cfg.Table != pkg.TABLE_COLUMNS {
+		return cfg, fmt.Errorf("unknown table '%s'", cfg.Table)
+	}
+	if cfg.Pipeline != "" && cfg.Pipeline != pkg.PIPELINE_STAGED && cfg.Pipeline != pkg.PIPELINE_FUSED && cfg.Pipeline != pkg.PIPELINE_PARTITIONED {
+		return cfg, fmt.Errorf("unknown pipeline '%s'", cfg.Pipeline)
+	}
+	if cfg.Parser != "" {
+		if _, err := pkg.NewParser(cfg.Parser, pkg.HASH_XXH3, false); err != nil {
+			return cfg, err
 		}
-		chanBlocks[chanIndex] <- buf[:n]
-		chanIndex = (chanIndex + 1) % CHANS
-		t.Since_SendBlocks += time.Since(t.SendBlocks)
 	}
-	t.SendEvent(time.Now(), "ReadFile: Read Done")
-	for i := range CHANS {
-		if chanBlocks[i] == nil {
-			chanBlocks[i] = make(BlockChan)
-			chanChanBlock <- chanBlocks[chanIndex]
+	if cfg.Hash != "" {
+		if _, err := pkg.NewHasher(cfg.Hash); err != nil {
+			return cfg, err
 		}
-		close(chanBlocks[i])
 	}
-	close(chanChanBlock)
-	t.Since_ReadFile = time.Since(tReadFile)
-	t.SendEvent(time.Now(), "ReadFile: Chans Done")
-
-	t.ParseBlocks = time.Now()
-	chanChanBatch := make(chan chan Batch, CHANS)
-	var wgParseBlocks sync.WaitGroup
-	wgParseBlocks.Add(CHANS)
-	go func(t *Timings) {
-		t.SendEvent(time.Now(), "ParseBlocks: Start")
-		for chanBlock := range chanChanBlock {
-			go func(t *Timings) {
-				t.SendEvent(time.Now(), "ParseBlocks: Chan Start")
-				chanBatch := make(chan Batch, BATCH_CHAN_BUF)
-				chanChanBatch <- chanBatch
-				batch := make(Batch, 0, HKV_BATCH)
-				for block := range chanBlock {
-					t.SendEvent(time.Now(), "ParseBlocks: RecvBlock")
-					for i := 0; i < len(block); i++ {
-						start := i
-						var val int
-						for ; block[i] != ';'; i++ {
-						}
-						key := block[start:i]
-						i++
-						val = 0
-						sign := 1
-						if block[i+1] == '-' {
-							i++
-							sign = -1
-						}
-						for ; block[i] != '.'; i++ {
-							val += int(block[i]-'0') + val*10
-						}
-						i++
-						val += int(block[i]-'0') + val*10
-						val *= sign
-						batch = append(batch, HKV{HK: HK{Hash: uint(xxh3.Hash(key)), Key: key}, Value: val})
-						if len(batch) >= HKV_BATCH {
-							t.SendBatches = time.Now()
-							chanBatch <- batch
-							t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(chanBatch)))
-							batch = make(Batch, 0, HKV_BATCH)
-							t.Since_SendBatches.Since(t.SendBatches)
-						}
-						for ; block[i] != '\n'; i++ {
-						}
-					}
-				}
-				t.SendBatches = time.Now()
-				chanBatch <- batch
-				t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(chanBatch)))
-				t.Since_SendBatches.Since(t.SendBatches)
-				close(chanBatch)
-				wgParseBlocks.Done()
-				t.SendEvent(time.Now(), "ParseBlocks: Chan Done")
-			}(t)
+	if cfg.Normalize != "" {
+		if _, err := pkg.NewNormalizer(cfg.Normalize); err != nil {
+			return cfg, err
 		}
-		tWaitParse := time.Now()
-		t.SendEvent(time.Now(), "ParseBlocks: Wait")
-		wgParseBlocks.Wait()
-		t.Since_WaitParse = time.Since(tWaitParse)
-		close(chanChanBatch)
-		t.Since_ParseBlock = time.Since(t.ParseBlocks)
-		t.SendEvent(time.Now(), "ParseBlocks: Done")
-	}(t)
+	}
+	if cfg.Stations != "" {
+		names, err := pkg.LoadStations(cfg.Stations)
+		if err != nil {
+			return cfg, err
+		}
+		if cfg.Normalize != "" {
+			n, _ := pkg.NewNormalizer(cfg.Normalize)
+			for i := range names {
+				names[i] = n.Canonical(names[i])
+			}
+		}
+		hash, _ := pkg.NewHasher(cmp.Or(cfg.Hash, pkg.HASH_XXH3))
+		if cfg.Perfect, err = pkg.NewPerfectHash(names, hash); err != nil {
+			return cfg, err
+		}
+		if n := len(cfg.Perfect.Collided); n > 0 {
+			log.Printf("warning: %d stations of '%s' share their %s hash with another, they fall back to the %s table: %q",
+				n, cfg.Stations, cmp.Or(cfg.Hash, pkg.HASH_XXH3), cmp.Or(cfg.Table, pkg.TABLE_MAP), cfg.Perfect.Collided)
+		}
+	}
+	return cfg, nil
+}
 
-	t.MapData = time.Now()
-	chanOutput := make(chan OutputMap, 32)
-	var wgMapData sync.WaitGroup
-	wgMapData.Add(CHANS)
-	go func(t *Timings) {
-		t.SendEvent(time.Now(), "MapData: Start")
-		for chanBatch := range chanChanBatch {
-			go func(t *Timings) {
-				t.SendEvent(time.Now(), "MapData: Chan Start")
-				output := make(OutputMap, MAP_SIZE)
-				for batch := range chanBatch {
-					for _, hkv := range batch {
-						val := hkv.Value
-						data, ok := output[hkv.Hash]
-						if !ok {
-							output[hkv.Hash] = &CityData{Min: val, Sum: val, Max: val, Count: 1, HK: hkv.HK}
-							continue
-						}
-						data.Min = min(data.Min, val)
-						data.Max = max(data.Max, val)
-						data.Sum += val
-						data.Count++
-					}
-					tSendOutput := time.Now()
-					chanOutput <- output
-					t.SendEvent(time.Now(), fmt.Sprintf("MapData: Send Output %d", len(chanOutput)))
-					t.SendOutput.Since(tSendOutput)
-				}
-				wgMapData.Done()
-				t.SendEvent(time.Now(), "MapData: Chan Done")
-			}(t)
+// ConfigFlags registers flags overriding the fields of DefaultConfig, 0 keeps the default.
+func ConfigFlags(flags *flag.FlagSet) *ConfigOverride {
+	o := &ConfigOverride{}
+	cfg := &o.Config
+	flags.StringVar(&o.File, "config", "", "JSON config file, e.g. written by 'tune' (flags below take precedence)")
+	flags.IntVar(&cfg.Workers, "workers", 0, "parse and map goroutines (0 = NumCPU/2+1)")
+	flags.IntVar(&cfg.ReadBuf, "read-buf", 0, "max block size in bytes (0 = from file size, up to 16MiB)")
+	flags.IntVar(&cfg.BlockChanBuf, "block-chan-buf", 0, "blocks buffered per worker (0 = from file size, up to 96)")
+	flags.IntVar(&cfg.BatchChanBuf, "batch-chan-buf", 0, "batches buffered per worker (0 = 10)")
+	flags.IntVar(&cfg.HKVBatch, "hkv-batch", 0, "rows per batch (0 = read-buf/16)")
+	flags.IntVar(&cfg.MapSize, "map-size", 0, "initial station map capacity (0 = 41343)")
+	flags.StringVar(&cfg.Table, "table", "", "station table: map (Go map), open (inline open addressing) or columns (arrays by station id) (empty = map)")
+	flags.StringVar(&cfg.Pipeline, "pipeline", "", "staged (parse and map goroutines linked by batches), fused (each worker parses into its own table) or partitioned (rows routed to one map shard per station, no merge) (empty = staged)")
+	flags.StringVar(&cfg.Parser, "parser", "", "row parser: scalar, swar or simd (AVX2/NEON when available) (empty = swar)")
+	flags.StringVar(&cfg.Hash, "hash", "", "station key hash: xxh3, fnv, wyhash or word (first/last 8 bytes and length) (empty = xxh3)")
+	flags.StringVar(&cfg.Stations, "stations", "", "known stations file (weather_stations.csv or an output) to aggregate into a perfect hashed array, others fall back to -table")
+	flags.BoolVar(&cfg.CheckParser, "check-parser", false, "cross-check every block of -parser against the scalar parser (slow)")
+	flags.BoolVar(&cfg.Release, "release", false, "drop processed parts of the file from memory as the workers finish them, for files larger than RAM")
+	flags.StringVar(&cfg.Normalize, "normalize", "", "canonicalize station names before aggregating: nfc, nfkc or casefold (NFKC and case folding) (empty = as is)")
+	return o
+}
+
+// ParseShard parses a '-shard' value of the form 'i/n'.
+func ParseShard(s string) (i, n int, err error) {
+	if _, err := fmt.Sscanf(s, "%d/%d", &i, &n); err != nil {
+		return 0, 0, fmt.Errorf("parse shard '%s': %w", s, err)
+	}
+	if n <= 0 || i < 0 || i >= n {
+		return 0, 0, fmt.Errorf("parse shard '%s': want 0 <= i < n", s)
+	}
+	return i, n, nil
+}
+
+// MergeFiles implements the 'merge' command, combining partial outputs of disjoint runs.
+// It returns the exit code.
+func MergeFiles(args []string) int {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	flagFormat := flags.String("format", FORMAT_TEXT, "output format: text|json|partial")
+	flagOrder := OrderFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: main merge [flags] <partial files...>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if !ValidFormat(*flagFormat) {
+		return Fail(fmt.Errorf("%w: unknown format '%s'", ErrUsage, *flagFormat))
+	}
+	order, err := flagOrder()
+	if err != nil {
+		return Fail(fmt.Errorf("%w: %w", ErrUsage, err))
+	}
+
+	output := make(OutputMap, pkg.STATIONS)
+	var windowed bool
+	for _, name := range flags.Args() {
+		input, err := os.ReadFile(name)
+		if err != nil {
+			return Fail(fmt.Errorf("%w: %w", ErrIO, err))
 		}
-		tWaitMap := time.Now()
-		t.SendEvent(time.Now(), "MapData: Wait")
-		wgMapData.Wait()
-		t.Since_WaitMap = time.Since(tWaitMap)
-		close(chanOutput)
-		t.Since_MapData = time.Since(t.MapData)
-		t.SendEvent(time.Now(), "MapData: Done")
-	}(t)
+		if windowed, err = ReadPartial(output, input, windowed); err != nil {
+			return Fail(fmt.Errorf("%w: %s: %w", ErrParse, name, err))
+		}
+	}
+	if err := PrintOutput(os.Stdout, output, PrintOptions{Format: *flagFormat, Windowed: windowed, Order: order}, &Timings{}); err != nil {
+		return Fail(err)
+	}
+	return 0
+}
 
-	t.SendEvent(time.Now(), "MergeMaps: Start")
-	output := make(OutputMap, MAP_SIZE)
-	tMergeWait := time.Now()
-	for subOutput := range chanOutput {
-		t.SendEvent(time.Now(), "MergeMaps: Chan Start")
-		t.Merge = time.Now()
-		if len(output) == 0 {
-			output = subOutput
-			t.Since_Merge += time.Since(t.Merge)
+// ReadPartial merges the stations of a partial output into output. It reports whether this or an earlier input,
+// as given by windowed, had window headers, rows are keyed by window from the first one on.
+func ReadPartial(output OutputMap, input []byte, windowed bool) (bool, error) {
+	var window int64
+	for _, line := range bytes.Split(input, []byte{'\n'}) {
+		if len(line) == 0 {
 			continue
 		}
-		for k, v := range subOutput {
-			if v0, ok := output[k]; ok {
-				v0.Merge(v)
-			} else {
-				output[k] = v
+		if header, ok := bytes.CutPrefix(line, []byte("# ")); ok {
+			ts, err := pkg.ParseTimestamp(header)
+			if err != nil {
+				return windowed, err
 			}
+			window, windowed = ts, true
+			continue
+		}
+		cd, err := pkg.ParsePartial(line)
+		if err != nil {
+			return windowed, err
 		}
-		t.Since_Merge += time.Since(t.Merge)
-		t.SendEvent(time.Now(), "MergeMaps: Chan End")
+		cd.HK.Hash = pkg.HashXXH3(cd.HK.Key)
+		if windowed {
+			cd.HK.Window = window
+			cd.HK.Hash = pkg.WindowHash(cd.HK.Key, window)
+		}
+		mergeStation(output, &cd)
 	}
-	t.Since_MergeWait = time.Since(tMergeWait)
-	t.SendEvent(time.Now(), "MergeMaps: End")
+	return windowed, nil
+}
 
-	t.SendEvent(time.Now(), "Print")
-	PrintOutput(output, t)
-	t.Report()
+// Aggregate runs the pipeline over line aligned data. Once ctx is done it returns what was aggregated so far.
+// With cfg.Release, data must be mapped, see pkg.Releaser.
+func Aggregate(ctx context.Context, cfg Config, data []byte, window time.Duration, t *Timings) (Stations, error) {
+	cfg, err := prepareRun(cfg, data)
+	if err != nil {
+		return nil, err
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	output := AggregateBlocks(gctx, g, cfg, ReadFile(gctx, cfg, data, t), window, t)
+	err = g.Wait()
+	finishRun(cfg, output, t)
+	return output, err
+}
+
+// prepareRun sets up the run-time parts of cfg for one run over data: the Interner, the Releaser with cfg.Release,
+// and the Normalizer with cfg.Normalize. data is nil if it is streamed, its blocks come from a BlockPool then.
+func prepareRun(cfg Config, data []byte) (Config, error) {
+	cfg.Interner = pkg.NewInterner()
+	if data == nil {
+		cfg.Blocks = pkg.NewBlockPool(cfg.ReadBuf)
+	} else if cfg.Release {
+		cfg.Releaser = pkg.NewReleaser(data)
+	}
+	if cfg.Normalize != "" {
+		var err error
+		if cfg.Normalizer, err = pkg.NewNormalizer(cfg.Normalize); err != nil {
+			return cfg, fmt.Errorf("%w: %w", ErrUsage, err)
+		}
+	}
+	return cfg, nil
 }
 
-func ReadFile(file string, percent int, t *Timings) (chanChanBlock chan BlockChan) {
+// finishRun adds what the run-time parts of cfg counted during a run with the given output to t.
+func finishRun(cfg Config, output Stations, t *Timings) {
+	if cfg.Releaser != nil {
+		t.Released = cfg.Releaser.Released
+	}
+	if cfg.Normalizer != nil {
+		t.Normalize = cfg.Normalize
+		t.Merged, t.RewrittenRows = cfg.Normalizer.Merged(output)
+	}
+}
+
+// AggregateBlocks runs the stages after reading, staged, fused or partitioned as cfg.Pipeline selects,
+// and sorts the result.
+func AggregateBlocks(ctx context.Context, g *errgroup.Group, cfg Config, chanBlock BlockChan, window time.Duration, t *Timings) Stations {
+	switch cfg.Pipeline {
+	case pkg.PIPELINE_FUSED:
+		return SortOutput(MergeMaps(cfg, FuseBlocks(ctx, g, cfg, chanBlock, window, t), t), t)
+	case pkg.PIPELINE_PARTITIONED:
+		return PartitionBlocks(ctx, g, cfg, chanBlock, window, t)
+	}
+	chanQueue := ParseBlocks(ctx, g, cfg, chanBlock, window, t)
+	chanOutput := MapData(cfg, chanQueue, t)
+	return SortOutput(MergeMaps(cfg, chanOutput, t), t)
+}
+
+// ReadFile splits data into line aligned blocks of up to cfg.ReadBuf bytes and queues them for cfg.Workers
+// workers, see dealer. A last line without a trailing '\n' is still processed. It stops dealing early once ctx is done.
+func ReadFile(ctx context.Context, cfg Config, data []byte, t *Timings) (chanBlock BlockChan) {
 	tReadFile := time.Now()
-	chanChanBlock = make(chan BlockChan, CHANS)
-	chanBlocks := make([]BlockChan, CHANS)
+	d := newDealer(cfg)
 
 	go func(t *Timings) {
 		t.SendEvent(time.Now(), "ReadFile: Start")
-		data, size, err := pkg.MMapFile(file)
-		if err != nil {
-			panic(err)
-		}
-
-		var limit int64 = int64(percent) * size / 100
-		var chanIndex int
-		for off := int64(0); off < limit; {
-			buf := data[off:min(size, off+READ_BUF)]
+		size := int64(len(data))
+		for off := int64(0); off < size && ctx.Err() == nil; {
+			buf := data[off:min(size, off+int64(cfg.ReadBuf))]
 			var n int
 			for n = len(buf) - 1; n >= 0; n-- {
 				if buf[n] == '\n' {
@@ -267,96 +459,162 @@ func ReadFile(file string, percent int, t *Timings) (chanChanBlock chan BlockCha
 				}
 			}
 
+			if n < 0 && off+int64(len(buf)) == size {
+				// a last line without a trailing '\n' is copied to add one, as ReadStream does
+				d.Deal(append(buf[:len(buf):len(buf)], '\n'), t)
+				break
+			}
 			if n <= 0 {
 				break
 			}
 
 			n++
 			off += int64(n)
-			t.SendBlocks = time.Now()
-			if chanBlocks[chanIndex] == nil {
-				chanBlocks[chanIndex] = make(BlockChan, BLOCK_CHAN_BUF)
-				chanChanBlock <- chanBlocks[chanIndex]
-			}
-
-			chanBlocks[chanIndex] <- buf[:n]
-			t.SendEvent(time.Now(), fmt.Sprintf("ReadFile: Send Block %d", len(chanBlocks[chanIndex])))
-			chanIndex = (chanIndex + 1) % CHANS
-			t.Since_SendBlocks += time.Since(t.SendBlocks)
+			d.Deal(buf[:n], t)
 		}
 		t.SendEvent(time.Now(), "ReadFile: File Done")
-		for i := range CHANS {
-			if chanBlocks[i] == nil {
-				chanBlocks[i] = make(BlockChan)
-				chanChanBlock <- chanBlocks[chanIndex]
-			}
-			close(chanBlocks[i])
-		}
-		close(chanChanBlock)
 		t.Since_ReadFile = time.Since(tReadFile)
+		d.Close()
 		t.SendEvent(time.Now(), "ReadFile Chans Closed")
 	}(t)
 
-	return chanChanBlock
+	return d.chanBlock
 }
 
-func ParseBlocks(chanChanBlock chan BlockChan, t *Timings) (chanChanBatch chan chan Batch) {
+// ReadStream is ReadFile for an io.Reader, each block is a buffer of up to cfg.ReadBuf bytes from cfg.Blocks,
+// which the workers put back once they are done with it. A last line without a trailing '\n' is still processed.
+// Read errors are reported through g.
+func ReadStream(ctx context.Context, g *errgroup.Group, cfg Config, r io.Reader, t *Timings) (chanBlock BlockChan) {
+	tReadFile := time.Now()
+	d := newDealer(cfg)
+
+	g.Go(func() error {
+		t.SendEvent(time.Now(), "ReadStream: Start")
+		defer func() {
+			t.SendEvent(time.Now(), "ReadStream: Stream Done")
+			t.Since_ReadFile = time.Since(tReadFile)
+			d.Close()
+			t.SendEvent(time.Now(), "ReadStream Chans Closed")
+		}()
+
+		buf := cfg.Blocks.Get()[:cfg.ReadBuf]
+		var n int
+		for ctx.Err() == nil {
+			m, err := io.ReadFull(r, buf[n:])
+			n += m
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				if n > 0 && buf[n-1] != '\n' {
+					buf = append(buf[:n:n], '\n')
+					n++
+				}
+				if n > 0 {
+					d.Deal(buf[:n], t)
+				}
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w: read stream: %w", ErrIO, err)
+			}
+
+			last := bytes.LastIndexByte(buf, '\n')
+			if last < 0 {
+				return fmt.Errorf("%w: read stream: line longer than %d bytes", ErrParse, cfg.ReadBuf)
+			}
+			d.Deal(buf[:last+1], t)
+			next := cfg.Blocks.Get()[:cfg.ReadBuf]
+			n = copy(next, buf[last+1:])
+			buf = next
+		}
+		return nil
+	})
+
+	return d.chanBlock
+}
+
+// dealer queues blocks on one channel all cfg.Workers workers pull from. A worker takes the next block as soon as
+// it is free, so a slow block only holds up its own worker instead of a queue of blocks dealt to it.
+type dealer struct {
+	chanBlock BlockChan
+}
+
+func newDealer(cfg Config) *dealer {
+	return &dealer{chanBlock: make(BlockChan, cfg.Workers*cfg.BlockChanBuf)}
+}
+
+func (d *dealer) Deal(block []byte, t *Timings) {
+	t.SendBlocks = time.Now()
+	d.chanBlock <- block
+	t.SendEvent(time.Now(), fmt.Sprintf("ReadFile: Send Block %d", len(d.chanBlock)))
+	t.Since_SendBlocks += time.Since(t.SendBlocks)
+}
+
+func (d *dealer) Close() {
+	close(d.chanBlock)
+}
+
+// newWorkers returns the TWorkers of cfg.Workers block workers, which report processed blocks to cfg.Releaser
+// or cfg.Blocks, whichever is set.
+func newWorkers(cfg Config) []pkg.TWorker {
+	workers := make([]pkg.TWorker, cfg.Workers)
+	for i := range workers {
+		switch {
+		case cfg.Releaser != nil:
+			workers[i].Done = cfg.Releaser.Done
+		case cfg.Blocks != nil:
+			workers[i].Done = cfg.Blocks.Done
+		}
+	}
+	return workers
+}
+
+// ParseBlocks parses the blocks of chanBlock on cfg.Workers goroutines into batches of cfg.HKVBatch rows.
+// Each worker's busy and idle time goes to t.PerWorker.
+// A window > 0 parses the timestamp column and keys rows by station and window.
+// Malformed blocks are reported through g, once ctx is done remaining blocks are drained without being parsed.
+func ParseBlocks(ctx context.Context, g *errgroup.Group, cfg Config, chanBlock BlockChan, window time.Duration, t *Timings) (chanQueue chan *batchQueue) {
 	t.ParseBlocks = time.Now()
-	chanChanBatch = make(chan chan Batch, CHANS)
+	chanQueue = make(chan *batchQueue, cfg.Workers)
+	t.PerWorker = newWorkers(cfg)
 
 	var wg sync.WaitGroup
-	wg.Add(CHANS)
+	wg.Add(cfg.Workers)
 	go func(t *Timings) {
 		t.SendEvent(time.Now(), "ParseBlocks: Start")
-		for chanBlock := range chanChanBlock {
-			go func(t *Timings) {
+		for i := range cfg.Workers {
+			w := &t.PerWorker[i]
+			g.Go(func() error {
 				t.SendEvent(time.Now(), "ParseBlocks: Chan Start")
-				chanBatch := make(chan Batch, BATCH_CHAN_BUF)
-				chanChanBatch <- chanBatch
-				batch := make(Batch, 0, HKV_BATCH)
-				for block := range chanBlock {
+				q := newBatchQueue(cfg, w)
+				chanQueue <- q
+				batch := make(Batch, 0, cfg.HKVBatch)
+				parser, names, err := newParser(cfg)
+				for block, ok := w.Recv(chanBlock); ok; block, ok = w.Recv(chanBlock) {
+					if err != nil || ctx.Err() != nil {
+						continue
+					}
 					t.SendEvent(time.Now(), "ParseBlocks: RecvBlock")
-					for i := 0; i < len(block); i++ {
-						start := i
-						var val int
-						for ; block[i] != ';'; i++ {
-						}
-						key := block[start:i]
-						i++
-						val = 0
-						sign := 1
-						if block[i+1] == '-' {
-							i++
-							sign = -1
-						}
-
-						for ; block[i] != '.'; i++ {
-							val += int(block[i]-'0') + val*10
-						}
-						i++
-						val += int(block[i]-'0') + val*10
-						val *= sign
-						batch = append(batch, HKV{HK: HK{Hash: uint(xxh3.Hash(key)), Key: key}, Value: val})
-						if len(batch) >= HKV_BATCH {
-							t.SendBatches = time.Now()
-							chanBatch <- batch
-							t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(chanBatch)))
-							batch = make(Batch, 0, HKV_BATCH)
-							t.Since_SendBatches.Since(t.SendBatches)
-						}
-
-						for ; block[i] != '\n'; i++ {
+					for len(block) > 0 && err == nil {
+						var n int
+						batch, n, err = parseBlock(parser, names, block, batch, window)
+						block = block[n:]
+						if len(batch) >= cfg.HKVBatch {
+							tSend := time.Now()
+							q.Send(batch)
+							t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(q.batches)))
+							batch = make(Batch, 0, cfg.HKVBatch)
+							t.Since_SendBatches.Since(tSend)
 						}
 					}
 				}
-				t.SendBatches = time.Now()
-				chanBatch <- batch
-				t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(chanBatch)))
-				t.Since_SendBatches.Since(t.SendBatches)
-				close(chanBatch)
+				tSend := time.Now()
+				q.Send(batch)
+				t.SendEvent(time.Now(), fmt.Sprintf("ParseBlocks: Send Batch %d", len(q.batches)))
+				t.Since_SendBatches.Since(tSend)
+				close(q.batches)
 				wg.Done()
 				t.SendEvent(time.Now(), "ParseBlocks: Chan Done")
-			}(t)
+				return err
+			})
 		}
 
 		tWaitParse := time.Now()
@@ -364,51 +622,256 @@ func ParseBlocks(chanChanBlock chan BlockChan, t *Timings) (chanChanBatch chan c
 		wg.Wait()
 		t.Since_WaitParse = time.Since(tWaitParse)
 
-		close(chanChanBatch)
 		t.Since_ParseBlock = time.Since(t.ParseBlocks)
+		close(chanQueue)
 		t.SendEvent(time.Now(), "ParseBlocks: Done")
 	}(t)
-	return chanChanBatch
+	return chanQueue
+}
+
+// batchQueue carries the batches of a parse worker to MapData. The blocks they point into are held back from the
+// worker's Done until MapData has mapped every batch with rows of them, only then may they be released or reused.
+type batchQueue struct {
+	batches chan Batch
+	done    func(block []byte) // nil if nothing is held back
+
+	mu     sync.Mutex
+	held   [][]byte
+	need   []int // batches to be mapped before held[i] is done
+	sent   int
+	mapped int
+	recvd  bool
+}
+
+// newBatchQueue returns the batchQueue of the parse worker w, taking over its Done.
+func newBatchQueue(cfg Config, w *pkg.TWorker) *batchQueue {
+	q := &batchQueue{batches: make(chan Batch, cfg.BatchChanBuf), done: w.Done}
+	if q.done != nil {
+		w.Done = q.hold
+	}
+	return q
+}
+
+// hold holds back a parsed block, its last rows are in the batch being filled.
+func (q *batchQueue) hold(block []byte) {
+	q.mu.Lock()
+	q.held = append(q.held, block)
+	q.need = append(q.need, q.sent+1)
+	q.mu.Unlock()
+}
+
+// Send queues a batch for MapData.
+func (q *batchQueue) Send(batch Batch) {
+	q.batches <- batch
+	q.mu.Lock()
+	q.sent++
+	q.mu.Unlock()
+}
+
+// Recv waits for the next batch, the previous one is mapped once MapData asks for it.
+func (q *batchQueue) Recv() (Batch, bool) {
+	if q.done != nil && q.recvd {
+		q.mu.Lock()
+		q.mapped++
+		for len(q.held) > 0 && q.need[0] <= q.mapped {
+			q.done(q.held[0])
+			q.held, q.need = q.held[1:], q.need[1:]
+		}
+		q.mu.Unlock()
+	}
+	batch, ok := <-q.batches
+	q.recvd = ok
+	return batch, ok
+}
+
+// newKeyCache returns a partition worker's KeyCache if the blocks its batches point into may be released or reused,
+// nil if not.
+func newKeyCache(cfg Config) *pkg.KeyCache {
+	if cfg.Releaser == nil && cfg.Blocks == nil {
+		return nil
+	}
+	return pkg.NewKeyCache(cfg.Interner)
 }
 
-func MapData(chanChanBatch chan chan Batch, t *Timings) (chanOutput chan OutputMap) {
+// newParser returns the parser and hasher cfg selects and, with cfg.Normalizer, a worker's NameCache rehashing
+// rewritten names with the same hasher.
+func newParser(cfg Config) (pkg.Parser, *pkg.NameCache, error) {
+	hash, err := pkg.NewHasher(cfg.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	var names *pkg.NameCache
+	if cfg.Normalizer != nil {
+		names = cfg.Normalizer.NewCache(hash)
+	}
+	parser, err := pkg.NewParser(cfg.Parser, cfg.Hash, cfg.CheckParser)
+	return parser, names, err
+}
+
+// parseBlock runs parser, or the windowed one for window > 0, on block, turning malformed rows into an ErrParse.
+// The fast parsers panic on malformed rows, ValidateBlock then explains what is wrong.
+// The names of the rows it appended are canonicalized by names, if not nil.
+func parseBlock(parser pkg.Parser, names *pkg.NameCache, block []byte, batch Batch, window time.Duration) (_ Batch, n int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %w", ErrParse, explain(block, fmt.Errorf("%v", r)))
+		}
+	}()
+
+	from := len(batch)
+	if window > 0 {
+		batch, n, err = pkg.ParseBlockWindowed(block, batch, window)
+	} else {
+		batch, n, err = parser.Parse(block, batch)
+	}
+	if names != nil {
+		names.Normalize(batch[from:], window > 0)
+	}
+	if errors.Is(err, pkg.ErrMalformed) {
+		err = explain(block, err)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %w", ErrParse, err)
+	}
+	return batch, n, err
+}
+
+// explain returns what ValidateBlock finds wrong with block, or err if it finds nothing: a parser may reject
+// rows ValidateBlock lets through, and its error must not be lost.
+func explain(block []byte, err error) error {
+	if verr := pkg.ValidateBlock(block); verr != nil {
+		return verr
+	}
+	return err
+}
+
+// FuseBlocks is ParseBlocks and MapData in one stage, each worker parses straight into a table of its own.
+func FuseBlocks(ctx context.Context, g *errgroup.Group, cfg Config, chanBlock BlockChan, window time.Duration, t *Timings) (chanOutput chan Partial) {
+	t.ParseBlocks = time.Now()
+	t.MapData = t.ParseBlocks
+	chanOutput = make(chan Partial, cfg.Workers)
+	dict := pkg.NewDictionary(cfg.MapSize, cfg.Interner)
+	t.PerWorker = newWorkers(cfg)
+
+	var wg sync.WaitGroup
+	wg.Add(cfg.Workers)
+	go func(t *Timings) {
+		t.SendEvent(time.Now(), "FuseBlocks: Start")
+		for i := range cfg.Workers {
+			w := &t.PerWorker[i]
+			g.Go(func() error {
+				defer wg.Done()
+				t.SendEvent(time.Now(), "FuseBlocks: Chan Start")
+				output, err := fuseBlocks(ctx, cfg, dict, chanBlock, window, w)
+				chanOutput <- output
+				t.SendEvent(time.Now(), "FuseBlocks: Chan Done")
+				return err
+			})
+		}
+
+		tWaitParse := time.Now()
+		t.SendEvent(time.Now(), "FuseBlocks: Wait")
+		wg.Wait()
+		t.Since_WaitParse = time.Since(tWaitParse)
+
+		// both stages are the same one
+		t.Since_ParseBlock = time.Since(t.ParseBlocks)
+		t.Since_MapData = t.Since_ParseBlock
+		close(chanOutput)
+		t.SendEvent(time.Now(), "FuseBlocks: Done")
+	}(t)
+	return chanOutput
+}
+
+// fuseBlocks parses and aggregates the blocks of one worker into the table cfg.Table selects.
+func fuseBlocks(ctx context.Context, cfg Config, dict *pkg.Dictionary, chanBlock BlockChan, window time.Duration, w *pkg.TWorker) (Partial, error) {
+	var m *pkg.CityMap
+	var c *pkg.Columns
+	var output OutputMap
+	switch cfg.Table {
+	case pkg.TABLE_OPEN:
+		m = pkg.NewCityMap(cfg.MapSize, cfg.Interner)
+	case pkg.TABLE_COLUMNS:
+		c = pkg.NewColumns(dict, cfg.MapSize)
+		output = OutputMap{}
+	default:
+		output = make(OutputMap, cfg.MapSize)
+	}
+	var pm *pkg.PerfectMap
+	if cfg.Perfect != nil {
+		pm = cfg.Perfect.NewMap()
+	}
+
+	batch := make(Batch, 0, FUSED_BATCH)
+	parser, names, err := newParser(cfg)
+	for block, ok := w.Recv(chanBlock); ok; block, ok = w.Recv(chanBlock) {
+		if err != nil || ctx.Err() != nil {
+			continue
+		}
+		for len(block) > 0 && err == nil {
+			var n int
+			batch, n, err = parseBlock(parser, names, block, batch[:0], window)
+			block = block[n:]
+			if pm != nil {
+				batch = pm.AddBatch(batch)
+			}
+			switch {
+			case m != nil:
+				for i := range batch {
+					m.Add(&batch[i].HK, batch[i].Value)
+				}
+			case c != nil:
+				c.AddBatch(batch)
+			default:
+				mapBatch(output, cfg.Interner, batch)
+			}
+		}
+	}
+
+	if m != nil {
+		output = openOutput(m)
+	}
+	perfectOutput(output, pm)
+	return Partial{Output: output, Columns: c}, err
+}
+
+// MapData aggregates every batch queue into its own table, handed on as a Partial.
+// It stops once ParseBlocks closes its batch queues, and keeps aggregating after a cancellation
+// so partial results include every parsed row.
+func MapData(cfg Config, chanQueue chan *batchQueue, t *Timings) (chanOutput chan Partial) {
 	t.MapData = time.Now()
-	// chanOutput = make(chan OutputMap, CHANS*16)
-	chanOutput = make(chan OutputMap, 32)
+	// chanOutput = make(chan Partial, cfg.Workers*16)
+	chanOutput = make(chan Partial, 32)
+	dict := pkg.NewDictionary(cfg.MapSize, cfg.Interner)
 	var wg sync.WaitGroup
-	wg.Add(CHANS)
+	wg.Add(cfg.Workers)
 	go func(t *Timings) {
 		t.SendEvent(time.Now(), "MapData: Start")
-		for chanBatch := range chanChanBatch {
+		for q := range chanQueue {
+			if cfg.Table == pkg.TABLE_OPEN {
+				go func(t *Timings) {
+					chanOutput <- Partial{Output: mapOpen(cfg, q, t)}
+					wg.Done()
+					t.SendEvent(time.Now(), "MapData: Chan Done")
+				}(t)
+				continue
+			}
+			if cfg.Table == pkg.TABLE_COLUMNS {
+				go func(t *Timings) {
+					chanOutput <- mapColumns(cfg, dict, q, t)
+					wg.Done()
+					t.SendEvent(time.Now(), "MapData: Chan Done")
+				}(t)
+				continue
+			}
 			go func(t *Timings) {
 				t.SendEvent(time.Now(), "MapData: Chan Start")
-				output := make(OutputMap, MAP_SIZE)
-				for batch := range chanBatch {
-					for _, hkv := range batch {
-						val := hkv.Value
-						data, ok := output[hkv.Hash]
-						if !ok {
-							output[hkv.Hash] = &CityData{
-								Min:   val,
-								Sum:   val,
-								Max:   val,
-								Count: 1,
-								HK:    hkv.HK,
-							}
-							continue
-						}
-
-						data.Min = min(data.Min, val)
-						data.Max = max(data.Max, val)
-						data.Sum += val
-						data.Count++
-					}
-					tSendOutput := time.Now()
-
-					chanOutput <- output
-					t.SendEvent(time.Now(), fmt.Sprintf("MapData: Send Output %d", len(chanOutput)))
-					t.SendOutput.Since(tSendOutput)
-				}
+				output := mapMap(cfg, q)
+				// sent once complete, MergeMaps links its stations into other maps
+				tSendOutput := time.Now()
+				chanOutput <- Partial{Output: output}
+				t.SendEvent(time.Now(), fmt.Sprintf("MapData: Send Output %d", len(chanOutput)))
+				t.SendOutput.Since(tSendOutput)
 				wg.Done()
 				t.SendEvent(time.Now(), "MapData: Chan Done")
 			}(t)
@@ -419,73 +882,319 @@ func MapData(chanChanBatch chan chan Batch, t *Timings) (chanOutput chan OutputM
 		wg.Wait()
 		t.Since_WaitMap = time.Since(tWaitMap)
 
-		close(chanOutput)
 		t.Since_MapData = time.Since(t.MapData)
+		close(chanOutput)
 		t.SendEvent(time.Now(), "MapData: Done")
 	}(t)
 
 	return chanOutput
 }
 
-func MergeMaps(chanOutput chan OutputMap, t *Timings) OutputMap {
+// mapMap aggregates a batch queue into an OutputMap.
+func mapMap(cfg Config, q *batchQueue) OutputMap {
+	output := make(OutputMap, cfg.MapSize)
+	var pm *pkg.PerfectMap
+	if cfg.Perfect != nil {
+		pm = cfg.Perfect.NewMap()
+	}
+	for batch, ok := q.Recv(); ok; batch, ok = q.Recv() {
+		if pm != nil {
+			batch = pm.AddBatch(batch)
+		}
+		mapBatch(output, cfg.Interner, batch)
+	}
+	perfectOutput(output, pm)
+	return output
+}
+
+// mapBatch aggregates a batch into output, interning the keys of new stations in interner.
+func mapBatch(output OutputMap, interner *pkg.Interner, batch Batch) {
+	for _, hkv := range batch {
+		val := hkv.Value
+		data := lookup(output, &hkv.HK)
+		if data == nil {
+			insert(output, &CityData{
+				Min:   val,
+				Sum:   val,
+				Max:   val,
+				Count: 1,
+				HK:    HK{Hash: hkv.Hash, Key: interner.Intern(hkv.Hash, hkv.Key), Window: hkv.Window},
+			})
+			continue
+		}
+
+		data.Min = min(data.Min, val)
+		data.Max = max(data.Max, val)
+		data.Sum += val
+		data.Count++
+	}
+}
+
+// mapOpen aggregates a batch queue into a CityMap and hands it on as an OutputMap pointing into its slots.
+func mapOpen(cfg Config, q *batchQueue, t *Timings) OutputMap {
+	t.SendEvent(time.Now(), "MapData: Chan Start")
+	m := pkg.NewCityMap(cfg.MapSize, cfg.Interner)
+	var pm *pkg.PerfectMap
+	if cfg.Perfect != nil {
+		pm = cfg.Perfect.NewMap()
+	}
+	for batch, ok := q.Recv(); ok; batch, ok = q.Recv() {
+		if pm != nil {
+			batch = pm.AddBatch(batch)
+		}
+		for i := range batch {
+			m.Add(&batch[i].HK, batch[i].Value)
+		}
+	}
+
+	tSendOutput := time.Now()
+	output := openOutput(m)
+	perfectOutput(output, pm)
+	t.SendOutput.Since(tSendOutput)
+	return output
+}
+
+// mapColumns aggregates a batch queue into Columns over the shared dict.
+func mapColumns(cfg Config, dict *pkg.Dictionary, q *batchQueue, t *Timings) Partial {
+	t.SendEvent(time.Now(), "MapData: Chan Start")
+	c := pkg.NewColumns(dict, cfg.MapSize)
+	var pm *pkg.PerfectMap
+	if cfg.Perfect != nil {
+		pm = cfg.Perfect.NewMap()
+	}
+	for batch, ok := q.Recv(); ok; batch, ok = q.Recv() {
+		if pm != nil {
+			batch = pm.AddBatch(batch)
+		}
+		c.AddBatch(batch)
+	}
+
+	output := OutputMap{}
+	perfectOutput(output, pm)
+	return Partial{Output: output, Columns: c}
+}
+
+// openOutput is the OutputMap of a CityMap, pointing into its slots.
+func openOutput(m *pkg.CityMap) OutputMap {
+	output := make(OutputMap, m.Len())
+	m.Each(func(cd *CityData) {
+		insert(output, cd)
+	})
+	return output
+}
+
+// perfectOutput adds the stations of a PerfectMap, if any, to output. They are never in it already,
+// the general tables only see the rows the PerfectMap did not know.
+func perfectOutput(output OutputMap, pm *pkg.PerfectMap) {
+	if pm == nil {
+		return
+	}
+	pm.Each(func(cd *CityData) {
+		insert(output, cd)
+	})
+}
+
+// lookup returns the station of hk in output, nil if it is not there yet.
+func lookup(output OutputMap, hk *HK) *CityData {
+	for cd := output[hk.Hash]; cd != nil; cd = cd.Next {
+		if cd.HK.Equal(hk) {
+			return cd
+		}
+	}
+	return nil
+}
+
+// insert adds a station missing from output, chained in front of any other station with its hash.
+func insert(output OutputMap, cd *CityData) {
+	cd.Next = output[cd.HK.Hash]
+	output[cd.HK.Hash] = cd
+}
+
+// each calls fn for every station of output, fn may insert the station into another OutputMap.
+func each(output OutputMap, fn func(cd *CityData)) {
+	for _, cd := range output {
+		for cd != nil {
+			next := cd.Next
+			fn(cd)
+			cd = next
+		}
+	}
+}
+
+// MergeMaps merges all outputs of MapData, it keeps collecting after a cancellation so partial results stay available.
+// Outputs are merged pairwise on goroutines of their own as they arrive, and every result goes back to be paired
+// again, so the merge is a tree of depth log(workers) instead of a chain. Since_Merge is the time the merge
+// takes once the last output is in. Columns are only turned into CityData at the root.
+func MergeMaps(cfg Config, chanOutput chan Partial, t *Timings) OutputMap {
 	t.SendEvent(time.Now(), "MergeMaps: Start")
-	output := make(OutputMap, MAP_SIZE)
 	tMergeWait := time.Now()
-	for subOutput := range chanOutput {
-		t.SendEvent(time.Now(), "MergeMaps: Chan Start")
-		t.Merge = time.Now()
-		if len(output) == 0 {
-			output = subOutput
-			t.Since_Merge += time.Since(t.Merge)
-			continue
+	chanMerged := make(chan Partial)
+	var held *Partial
+	pending := 0
+	take := func(p Partial) {
+		if held == nil {
+			held = &p
+			return
 		}
-		for k, v := range subOutput {
-			if v0, ok := output[k]; ok {
-				v0.Merge(v)
-			} else {
-				output[k] = v
+		a := *held
+		held = nil
+		pending++
+		go func() {
+			chanMerged <- mergePartials(a, p)
+		}()
+	}
+
+	in := chanOutput
+	for in != nil || pending > 0 {
+		select {
+		case p, ok := <-in:
+			if !ok {
+				in = nil
+				t.Merge = time.Now()
+				continue
 			}
+			t.SendEvent(time.Now(), "MergeMaps: Chan Start")
+			take(p)
+		case p := <-chanMerged:
+			pending--
+			t.SendEvent(time.Now(), "MergeMaps: Chan End")
+			take(p)
+		}
+	}
+
+	output := make(OutputMap, cfg.MapSize)
+	if held != nil {
+		output = held.Output
+		if held.Columns != nil {
+			held.Columns.Each(func(cd *CityData) {
+				mergeStation(output, cd)
+			})
 		}
-		t.Since_Merge += time.Since(t.Merge)
-		t.SendEvent(time.Now(), "MergeMaps: Chan End")
 	}
+	t.Since_Merge = time.Since(t.Merge)
 	t.Since_MergeWait = time.Since(tMergeWait)
 	t.SendEvent(time.Now(), "MergeMaps: End")
 	return output
 }
 
-func PrintOutput(output OutputMap, t *Timings) {
-	t.SendEvent(time.Now(), "Print: Sort")
-	tSort := time.Now()
-	hks := make([]HK, 0, len(output))
-	for _, v := range output {
-		hks = append(hks, v.HK)
+// mergePartials merges the smaller OutputMap into the larger and b's Columns into a's.
+func mergePartials(a, b Partial) Partial {
+	if len(a.Output) < len(b.Output) {
+		a.Output, b.Output = b.Output, a.Output
 	}
+	each(b.Output, func(cd *CityData) {
+		mergeStation(a.Output, cd)
+	})
+	switch {
+	case a.Columns == nil:
+		a.Columns = b.Columns
+	case b.Columns != nil:
+		a.Columns.Merge(b.Columns)
+	}
+	return a
+}
 
-	sort.Slice(hks, func(i, j int) bool {
-		ki, kj := hks[i].Key, hks[j].Key
-		for k := 0; k < len(ki) && k < len(kj); k++ {
-			if ki[k] != kj[k] {
-				return ki[k] < kj[k]
-			}
-		}
-		return len(ki) < len(kj)
+// mergeStation merges cd into its station in output, or inserts it if output does not have it yet.
+func mergeStation(output OutputMap, cd *CityData) {
+	if v0 := lookup(output, &cd.HK); v0 != nil {
+		v0.Merge(cd)
+	} else {
+		insert(output, cd)
+	}
+}
+
+// ValidFormat reports whether PrintOutput supports format.
+func ValidFormat(format string) bool {
+	switch format {
+	case FORMAT_TEXT, FORMAT_PARTIAL, FORMAT_JSON:
+		return true
+	}
+	return false
+}
+
+// PrintOptions selects how PrintStations renders the stations.
+type PrintOptions struct {
+	Format   string
+	Windowed bool  // one block per time window, each headed by '# <window start>'
+	Order    Order // of the stations within a window, the zero Order keeps SortOutput's
+}
+
+// PrintOutput sorts output and writes it, see PrintStations.
+func PrintOutput(w io.Writer, output OutputMap, opts PrintOptions, t *Timings) error {
+	return PrintStations(w, SortOutput(output, t), opts, t)
+}
+
+// SortOutput lists the stations of output in print order.
+func SortOutput(output OutputMap, t *Timings) Stations {
+	t.SendEvent(time.Now(), "Sort")
+	tSort := time.Now()
+	cds := make(Stations, 0, len(output))
+	each(output, func(cd *CityData) {
+		cds = append(cds, cd)
 	})
+	slices.SortFunc(cds, compareStations)
 	t.Since_Sort = time.Since(tSort)
+	return cds
+}
 
+// compareStations orders stations by window, then by name byte by byte.
+func compareStations(a, b *CityData) int {
+	if a.HK.Window != b.HK.Window {
+		return cmp.Compare(a.HK.Window, b.HK.Window)
+	}
+	return bytes.Compare(a.HK.Key, b.HK.Key)
+}
+
+// PrintStations writes stations sorted by SortOutput in opts.Format and opts.Order.
+func PrintStations(w io.Writer, cds Stations, opts PrintOptions, t *Timings) error {
+	cds = opts.Order.Apply(cds, t)
 	t.SendEvent(time.Now(), "Print: Build")
 	tBuild := time.Now()
 	var sb strings.Builder
-	for _, k := range hks {
-		data := output[k.Hash]
-		fmt.Fprintf(&sb, "%s=%s/%s/%s\n", k.Key,
-			pkg.PrintIndec(data.Min), pkg.PrintIndec(data.Sum/data.Count), pkg.PrintIndec(data.Max))
+	if opts.Format == FORMAT_JSON {
+		sb.WriteString("[\n")
+	}
+	for i, data := range cds {
+		k := data.HK
+		var window string
+		if opts.Windowed {
+			window = time.Unix(k.Window, 0).UTC().Format(time.RFC3339)
+		}
+		if opts.Windowed && opts.Format != FORMAT_JSON && (i == 0 || k.Window != cds[i-1].HK.Window) {
+			fmt.Fprintf(&sb, "# %s\n", window)
+		}
+		switch opts.Format {
+		case FORMAT_JSON:
+			name, _ := json.Marshal(string(k.Key))
+			if i > 0 {
+				sb.WriteString(",\n")
+			}
+			sb.WriteString("{")
+			if opts.Windowed {
+				fmt.Fprintf(&sb, `"window":"%s",`, window)
+			}
+			fmt.Fprintf(&sb, `"name":%s,"min":%s,"mean":%s,"max":%s,"count":%d}`, name,
+				pkg.PrintIndec(data.Min), pkg.PrintIndec(data.Sum/data.Count), pkg.PrintIndec(data.Max), data.Count)
+		case FORMAT_PARTIAL:
+			fmt.Fprintf(&sb, "%s=%s/%s/%d/%s\n", k.Key,
+				pkg.PrintIndec(data.Min), pkg.PrintIndec(data.Sum), data.Count, pkg.PrintIndec(data.Max))
+		default:
+			fmt.Fprintf(&sb, "%s=%s/%s/%s\n", k.Key,
+				pkg.PrintIndec(data.Min), pkg.PrintIndec(data.Sum/data.Count), pkg.PrintIndec(data.Max))
+		}
+	}
+	if opts.Format == FORMAT_JSON {
+		sb.WriteString("\n]\n")
 	}
 	t.Since_Build = time.Since(tBuild)
 
 	t.SendEvent(time.Now(), "Print: Write")
 	tPrint := time.Now()
-	os.Stdout.WriteString(sb.String())
+	_, err := io.WriteString(w, sb.String())
 	t.Since_Print = time.Since(tPrint)
 	t.SendEvent(time.Now(), "Print: End")
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrOutput, err)
+	}
+	return nil
 }
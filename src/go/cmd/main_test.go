@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"brc/pkg"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// testData returns rows of a few stations with random temperatures.
+func testData(rows int) []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	var data []byte
+	for range rows {
+		data = fmt.Appendf(data, "Station %d;%s\n", rng.IntN(50), pkg.PrintIndec(rng.IntN(1999)-999))
+	}
+	return data
+}
+
+// TestMergeShards checks that merging the partial outputs of the shards of a file gives the output of a run over
+// all of it, for shard counts that cut rows at different places.
+func TestMergeShards(t *testing.T) {
+	data := testData(10_000)
+	aggregate := func(data []byte, format string) []byte {
+		t.Helper()
+		output, err := Aggregate(context.Background(), pkg.DefaultConfig(int64(len(data))), data, 0, &Timings{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := PrintStations(&buf, output, PrintOptions{Format: format}, &Timings{}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	want := aggregate(data, FORMAT_TEXT)
+	for _, n := range []int{1, 2, 3, 7, 64} {
+		merged := make(OutputMap, pkg.STATIONS)
+		for i := range n {
+			start, end := pkg.ShardRange(data, i, n)
+			if _, err := ReadPartial(merged, aggregate(data[start:end], FORMAT_PARTIAL), false); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got bytes.Buffer
+		if err := PrintOutput(&got, merged, PrintOptions{Format: FORMAT_TEXT}, &Timings{}); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("merging %d shards gives\n%s\nwant\n%s", n, got.Bytes(), want)
+		}
+	}
+}
+
+// TestReadStream checks that the stream buffers are only reused once no batch points into them any more: every
+// pipeline aggregates a stream read into small recycled blocks like a run over the whole input.
+func TestReadStream(t *testing.T) {
+	data := testData(10_000)
+	print := func(output Stations) string {
+		var buf bytes.Buffer
+		if err := PrintStations(&buf, output, PrintOptions{Format: FORMAT_TEXT}, &Timings{}); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	output, err := Aggregate(context.Background(), pkg.DefaultConfig(int64(len(data))), data, 0, &Timings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := print(output)
+
+	for _, pipeline := range []string{pkg.PIPELINE_STAGED, pkg.PIPELINE_FUSED, pkg.PIPELINE_PARTITIONED} {
+		small := Config{Workers: 3, ReadBuf: 256, BlockChanBuf: 1, BatchChanBuf: 1, HKVBatch: 8, Pipeline: pipeline}
+		cfg, err := prepareRun(pkg.DefaultConfig(0).Override(small), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g, ctx := errgroup.WithContext(context.Background())
+		timings := &Timings{}
+		output := AggregateBlocks(ctx, g, cfg, ReadStream(ctx, g, cfg, bytes.NewReader(data), timings), 0, timings)
+		if err := g.Wait(); err != nil {
+			t.Fatal(err)
+		}
+		if got := print(output); got != want {
+			t.Errorf("%s pipeline gives\n%s\nwant\n%s", pipeline, got, want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	SORT_BYTES   = "bytes"   // names byte by byte, the default
+	SORT_UNICODE = "unicode" // NFC normalized names by code point
+	SORT_COLLATE = "collate" // 'collate:<lang>', names by the collation rules of a BCP 47 language
+
+	SORT_BY_NAME  = "name"
+	SORT_BY_MEAN  = "mean"
+	SORT_BY_MIN   = "min"
+	SORT_BY_MAX   = "max"
+	SORT_BY_COUNT = "count"
+)
+
+// Order is the print order of the stations of a window: by name, compared as Sort says, or by a value with
+// ties broken by name. Windows always stay in ascending order.
+type Order struct {
+	Sort string
+	By   string
+	Desc bool
+	lang language.Tag // of SORT_COLLATE
+}
+
+// ParseOrder parses the '-sort' and '-sort-by' values, 'bytes|unicode|collate:<lang>' and
+// 'name|mean|min|max|count' with an optional ':asc' or ':desc'. Empty values are the default order.
+func ParseOrder(sort, by string) (Order, error) {
+	o := Order{Sort: SORT_BYTES, By: SORT_BY_NAME}
+	switch name, lang, _ := strings.Cut(sort, ":"); name {
+	case "", SORT_BYTES, SORT_UNICODE:
+		if lang != "" {
+			return o, fmt.Errorf("sort '%s': only %s takes a language", sort, SORT_COLLATE)
+		}
+		if name != "" {
+			o.Sort = name
+		}
+	case SORT_COLLATE:
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return o, fmt.Errorf("sort '%s': %w", sort, err)
+		}
+		o.Sort, o.lang = SORT_COLLATE, tag
+	default:
+		return o, fmt.Errorf("unknown sort '%s'", sort)
+	}
+
+	field, dir, _ := strings.Cut(by, ":")
+	switch field {
+	case "":
+	case SORT_BY_NAME, SORT_BY_MEAN, SORT_BY_MIN, SORT_BY_MAX, SORT_BY_COUNT:
+		o.By = field
+	default:
+		return o, fmt.Errorf("unknown sort-by '%s'", by)
+	}
+	switch dir {
+	case "", "asc":
+	case "desc":
+		o.Desc = true
+	default:
+		return o, fmt.Errorf("sort-by '%s': want asc or desc", by)
+	}
+	return o, nil
+}
+
+// OrderFlags registers '-sort' and '-sort-by' on flags and returns a function parsing them once flags are parsed.
+func OrderFlags(flags *flag.FlagSet) func() (Order, error) {
+	sort := flags.String("sort", "", "station name order: bytes, unicode (NFC, by code point) or collate:<lang>, e.g. collate:sv (empty = bytes)")
+	by := flags.String("sort-by", "", "sort by name, mean, min, max or count, optionally followed by :asc or :desc, ties by name (empty = name)")
+	return func() (Order, error) {
+		return ParseOrder(*sort, *by)
+	}
+}
+
+// Default reports whether o is the byte order the stations are sorted in by SortOutput.
+func (o Order) Default() bool {
+	return (o.Sort == "" || o.Sort == SORT_BYTES) && (o.By == "" || o.By == SORT_BY_NAME) && !o.Desc
+}
+
+// Apply returns stations sorted by SortOutput reordered into o, adding the time taken to t.Since_Sort.
+// cds is left as is, it may be shared by several requests.
+func (o Order) Apply(cds Stations, t *Timings) Stations {
+	if o.Default() {
+		return cds
+	}
+	tSort := time.Now()
+	type sortKey struct {
+		cd   *CityData
+		name []byte
+	}
+	keys := make([]sortKey, len(cds))
+	var collator *collate.Collator
+	var buf collate.Buffer
+	if o.Sort == SORT_COLLATE {
+		collator = collate.New(o.lang)
+	}
+	for i, cd := range cds {
+		keys[i] = sortKey{cd: cd, name: cd.HK.Key}
+		switch o.Sort {
+		case SORT_UNICODE:
+			keys[i].name = norm.NFC.Bytes(cd.HK.Key)
+		case SORT_COLLATE:
+			keys[i].name = collator.Key(&buf, cd.HK.Key)
+		}
+	}
+
+	slices.SortStableFunc(keys, func(a, b sortKey) int {
+		if a.cd.HK.Window != b.cd.HK.Window {
+			return cmp.Compare(a.cd.HK.Window, b.cd.HK.Window)
+		}
+		c := o.compareValues(a.cd, b.cd)
+		if o.By == "" || o.By == SORT_BY_NAME {
+			c = bytes.Compare(a.name, b.name)
+		}
+		if o.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+		return bytes.Compare(a.name, b.name)
+	})
+	sorted := make(Stations, len(keys))
+	for i := range keys {
+		sorted[i] = keys[i].cd
+	}
+	t.Since_Sort += time.Since(tSort)
+	return sorted
+}
+
+// compareValues compares the o.By values of two stations, means unrounded.
+func (o Order) compareValues(a, b *CityData) int {
+	switch o.By {
+	case SORT_BY_MEAN:
+		return cmp.Compare(float64(a.Sum)/float64(a.Count), float64(b.Sum)/float64(b.Count))
+	case SORT_BY_MIN:
+		return cmp.Compare(a.Min, b.Min)
+	case SORT_BY_MAX:
+		return cmp.Compare(a.Max, b.Max)
+	case SORT_BY_COUNT:
+		return cmp.Compare(a.Count, b.Count)
+	}
+	return 0
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"brc/pkg"
+	"container/heap"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// PartitionBlocks parses like ParseBlocks but routes each row by HK.Hash to one of cfg.Workers shards, so no station
+// is in two tables. The shards sort their stations and a k-way merge interleaves them.
+func PartitionBlocks(ctx context.Context, g *errgroup.Group, cfg Config, chanBlock BlockChan, window time.Duration, t *Timings) Stations {
+	t.ParseBlocks = time.Now()
+	chanShards := make([]chan Batch, cfg.Workers)
+	for i := range chanShards {
+		chanShards[i] = make(chan Batch, cfg.BatchChanBuf)
+	}
+	t.PerWorker = newWorkers(cfg)
+
+	var wg sync.WaitGroup
+	wg.Add(cfg.Workers)
+	go func(t *Timings) {
+		t.SendEvent(time.Now(), "PartitionBlocks: Start")
+		for i := range cfg.Workers {
+			w := &t.PerWorker[i]
+			g.Go(func() error {
+				defer wg.Done()
+				t.SendEvent(time.Now(), "PartitionBlocks: Chan Start")
+				err := partitionBlocks(ctx, cfg, chanBlock, chanShards, window, w, t)
+				t.SendEvent(time.Now(), "PartitionBlocks: Chan Done")
+				return err
+			})
+		}
+
+		tWaitParse := time.Now()
+		wg.Wait()
+		t.Since_WaitParse = time.Since(tWaitParse)
+		t.Since_ParseBlock = time.Since(t.ParseBlocks)
+		for _, chanShard := range chanShards {
+			close(chanShard)
+		}
+		t.SendEvent(time.Now(), "PartitionBlocks: Done")
+	}(t)
+
+	t.MapData = time.Now()
+	sorted := make([]Stations, len(chanShards))
+	sorts := make([]time.Duration, len(chanShards))
+	var wgShards sync.WaitGroup
+	wgShards.Add(len(chanShards))
+	for i, chanShard := range chanShards {
+		go func() {
+			defer wgShards.Done()
+			sorted[i], sorts[i] = shardStations(cfg, chanShard, t)
+			t.SendEvent(time.Now(), "PartitionBlocks: Shard Done")
+		}()
+	}
+	wgShards.Wait()
+	// the shards sort in parallel, so only the slowest one counts
+	t.Since_Sort = slices.Max(sorts)
+	t.Since_MapData = time.Since(t.MapData) - t.Since_Sort
+
+	tMerge := time.Now()
+	output := mergeSorted(sorted)
+	t.Since_KMerge = time.Since(tMerge)
+	t.SendEvent(time.Now(), "PartitionBlocks: K-Merge Done")
+	return output
+}
+
+// partitionBlocks parses the blocks of one worker and splits the rows into batches per shard.
+func partitionBlocks(ctx context.Context, cfg Config, chanBlock BlockChan, chanShards []chan Batch, window time.Duration, w *pkg.TWorker, t *Timings) error {
+	size := max(1, cfg.HKVBatch/len(chanShards))
+	shards := make([]Batch, len(chanShards))
+	for i := range shards {
+		shards[i] = make(Batch, 0, size)
+	}
+
+	batch := make(Batch, 0, FUSED_BATCH)
+	parser, names, err := newParser(cfg)
+	keys := newKeyCache(cfg)
+	for block, ok := w.Recv(chanBlock); ok; block, ok = w.Recv(chanBlock) {
+		if err != nil || ctx.Err() != nil {
+			continue
+		}
+		for len(block) > 0 && err == nil {
+			var n int
+			batch, n, err = parseBlock(parser, names, block, batch[:0], window)
+			block = block[n:]
+			if keys != nil {
+				keys.Copy(batch)
+			}
+
+			tRoute := time.Now()
+			for _, hkv := range batch {
+				i := hkv.Hash % uint(len(shards))
+				shards[i] = append(shards[i], hkv)
+				if len(shards[i]) == size {
+					chanShards[i] <- shards[i]
+					shards[i] = make(Batch, 0, size)
+				}
+			}
+			t.Since_Route.Since(tRoute)
+		}
+	}
+	for i := range shards {
+		if len(shards[i]) > 0 {
+			chanShards[i] <- shards[i]
+		}
+	}
+	return err
+}
+
+// shardStations aggregates the batches of one shard into the table cfg.Table selects, and returns its stations
+// sorted along with the time the sort took.
+func shardStations(cfg Config, chanShard chan Batch, t *Timings) (Stations, time.Duration) {
+	q := &batchQueue{batches: chanShard} // nothing is held back, partitionBlocks copies the keys, see newKeyCache
+	var p Partial
+	switch cfg.Table {
+	case pkg.TABLE_OPEN:
+		p.Output = mapOpen(cfg, q, t)
+	case pkg.TABLE_COLUMNS:
+		p = mapColumns(cfg, pkg.NewDictionary(cfg.MapSize, cfg.Interner), q, t)
+	default:
+		p.Output = mapMap(cfg, q)
+	}
+	if p.Columns != nil {
+		p.Columns.Each(func(cd *CityData) {
+			mergeStation(p.Output, cd)
+		})
+	}
+
+	// Timings of its own, the shards sort concurrently
+	ts := &Timings{}
+	cds := SortOutput(p.Output, ts)
+	return cds, ts.Since_Sort
+}
+
+// mergeSorted interleaves sorted lists of distinct stations into one sorted list.
+func mergeSorted(lists []Stations) Stations {
+	n := 0
+	h := make(sortedHeap, 0, len(lists))
+	for _, l := range lists {
+		n += len(l)
+		if len(l) > 0 {
+			h = append(h, l)
+		}
+	}
+	heap.Init(&h)
+
+	output := make(Stations, 0, n)
+	for len(h) > 0 {
+		output = append(output, h[0][0])
+		h[0] = h[0][1:]
+		if len(h[0]) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return output
+}
+
+// sortedHeap orders non-empty sorted lists by their first station.
+type sortedHeap []Stations
+
+func (h sortedHeap) Len() int           { return len(h) }
+func (h sortedHeap) Less(i, j int) bool { return compareStations(h[i][0], h[j][0]) < 0 }
+func (h sortedHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sortedHeap) Push(x any)        { *h = append(*h, x.(Stations)) }
+func (h *sortedHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
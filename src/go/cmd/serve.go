@@ -0,0 +1,257 @@
+package main
+
+import (
+	"brc/pkg"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ACCEPT_FORMATS maps the media types understood in an 'Accept' header to PrintOutput formats.
+var ACCEPT_FORMATS = map[string]string{
+	"text/plain":          FORMAT_TEXT,
+	"application/json":    FORMAT_JSON,
+	"text/x-1brc-partial": FORMAT_PARTIAL,
+}
+
+type server struct {
+	root string
+	jobs chan struct{}
+	cfg  Config // config file and flag overrides, completed per request by DefaultConfig
+}
+
+// Serve implements the 'serve' command, an HTTP front end to the aggregation pipeline.
+//
+//	POST /aggregate           aggregates the (optionally gzip/deflate encoded) request body
+//	GET  /aggregate?file=...  aggregates a file below -root
+//
+// Both accept '?window=1h' to aggregate timestamped rows per tumbling window.
+func Serve(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	flagAddr := flags.String("addr", ":8080", "listen address")
+	flagRoot := flags.String("root", "../../data", "directory files of 'GET /aggregate?file=' are resolved in")
+	flagJobs := flags.Int("jobs", 2, "max concurrent aggregation jobs, further requests wait for a free slot")
+	flagConfig := ConfigFlags(flags)
+	flags.Parse(args)
+	cfg, err := flagConfig.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s := &server{root: *flagRoot, jobs: make(chan struct{}, max(1, *flagJobs)), cfg: cfg}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /aggregate", s.PostAggregate)
+	mux.HandleFunc("GET /aggregate", s.GetAggregate)
+
+	log.Printf("serving on '%s'", *flagAddr)
+	log.Fatal(http.ListenAndServe(*flagAddr, mux))
+}
+
+func (s *server) PostAggregate(w http.ResponseWriter, r *http.Request) {
+	opts, window, ok := printOptions(w, r)
+	if !ok {
+		return
+	}
+
+	var body io.Reader = r.Body
+	switch enc := r.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	default:
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding '%s'", enc), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	ctx := r.Context()
+	if !s.acquire(ctx) {
+		return
+	}
+	defer s.release()
+
+	// ContentLength is -1 for chunked bodies, which DefaultConfig treats as unknown
+	cfg, err := prepareRun(pkg.DefaultConfig(r.ContentLength).Override(s.cfg), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t := &pkg.Timings{Start: time.Now(), Workers: cfg.Workers}
+	g, gctx := errgroup.WithContext(ctx)
+	output := AggregateBlocks(gctx, g, cfg, ReadStream(gctx, g, cfg, body, t), window, t)
+	err = g.Wait()
+	finishRun(cfg, output, t)
+	if err != nil {
+		if ctx.Err() == nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+	s.respond(w, r, output, opts, t)
+}
+
+func (s *server) GetAggregate(w http.ResponseWriter, r *http.Request) {
+	opts, window, ok := printOptions(w, r)
+	if !ok {
+		return
+	}
+
+	file := r.URL.Query().Get("file")
+	if !filepath.IsLocal(file) {
+		http.Error(w, fmt.Sprintf("file '%s' is not a local path", file), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	if !s.acquire(ctx) {
+		return
+	}
+	defer s.release()
+
+	t := &pkg.Timings{Start: time.Now()}
+	path, err := s.resolve(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data, size, err := pkg.MMapFile(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer pkg.MUnmapFile(data)
+
+	cfg := pkg.DefaultConfig(size).Override(s.cfg)
+	t.Workers = cfg.Workers
+	output, err := Aggregate(ctx, cfg, data, window, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	s.respond(w, r, output, opts, t)
+}
+
+// resolve returns the path of a local file below s.root with symlinks resolved, failing if they lead outside of it.
+func (s *server) resolve(file string) (string, error) {
+	root, err := filepath.EvalSymlinks(s.root)
+	if err != nil {
+		return "", err
+	}
+	path, err := filepath.EvalSymlinks(filepath.Join(root, file))
+	if err != nil {
+		return "", err
+	}
+	if rel, err := filepath.Rel(root, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("file '%s' is outside the root", file)
+	}
+	return path, nil
+}
+
+// acquire waits for a job slot, it fails once the request is cancelled.
+func (s *server) acquire(ctx context.Context) bool {
+	select {
+	case s.jobs <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s *server) release() {
+	<-s.jobs
+}
+
+// respond writes output and reports the request's Timings in a 'Server-Timing' trailer.
+func (s *server) respond(w http.ResponseWriter, r *http.Request, output Stations, opts PrintOptions, t *Timings) {
+	w.Header().Set("Content-Type", ContentType(opts.Format))
+	w.Header().Set("Trailer", "Server-Timing")
+	if err := PrintStations(w, output, opts, t); err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL, err)
+		return
+	}
+
+	var timing []string
+	for _, p := range t.Phases() {
+		timing = append(timing, fmt.Sprintf("%s;dur=%.3f", p.Name, float64(p.Duration.Microseconds())/1000))
+	}
+	w.Header().Set("Server-Timing", strings.Join(timing, ", "))
+	log.Printf("%s %s: %d stations, %s", r.Method, r.URL, len(output), strings.Join(timing, ", "))
+}
+
+// printOptions reads the output format from 'Accept' and the window and order from the query, failing the request
+// on errors.
+func printOptions(w http.ResponseWriter, r *http.Request) (opts PrintOptions, window time.Duration, ok bool) {
+	if opts.Format, ok = acceptFormat(r.Header.Get("Accept")); !ok {
+		http.Error(w, "supported: text/plain, application/json, text/x-1brc-partial", http.StatusNotAcceptable)
+		return opts, 0, false
+	}
+	if s := r.URL.Query().Get("window"); s != "" {
+		var err error
+		if window, err = pkg.ParseWindow(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return opts, 0, false
+		}
+		opts.Windowed = true
+	}
+	var err error
+	if opts.Order, err = ParseOrder(r.URL.Query().Get("sort"), r.URL.Query().Get("sort-by")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return opts, 0, false
+	}
+	return opts, window, true
+}
+
+// ContentType is the media type of a PrintOutput format.
+func ContentType(format string) string {
+	if format == FORMAT_JSON {
+		return "application/json"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// acceptFormat picks the first supported format listed in an 'Accept' header, defaulting to text.
+func acceptFormat(accept string) (string, bool) {
+	if accept == "" {
+		return FORMAT_TEXT, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if format, ok := ACCEPT_FORMATS[mediaType]; ok {
+			return format, true
+		}
+		if mediaType == "*/*" || mediaType == "text/*" {
+			return FORMAT_TEXT, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestResolve follows symlinks below the root and refuses the ones leading out of it.
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	for _, d := range []string{root, filepath.Join(root, "sub"), filepath.Join(dir, "outside")} {
+		if err := os.Mkdir(d, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{filepath.Join(root, "sub", "a.txt"), filepath.Join(dir, "outside", "b.txt")} {
+		if err := os.WriteFile(f, []byte("A;1.0\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"in.txt":  filepath.Join("sub", "a.txt"),
+		"out.txt": filepath.Join(dir, "outside", "b.txt"),
+		"up":      filepath.Join("..", "outside"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("symlinks: %v", err)
+		}
+	}
+
+	s := &server{root: root}
+	for file, ok := range map[string]bool{
+		"sub/a.txt":     true,
+		"in.txt":        true,
+		"out.txt":       false,
+		"up/b.txt":      false,
+		"missing":       false,
+		"sub/../in.txt": true,
+	} {
+		if _, err := s.resolve(file); (err == nil) != ok {
+			t.Errorf("resolve(%s) = %v, want ok %v", file, err, ok)
+		}
+	}
+}
+
+// TestGetLastLine checks that GET aggregates a file's last line without '\n' like POST does.
+func TestGetLastLine(t *testing.T) {
+	root := t.TempDir()
+	data := string(testData(1000)) + "Last;-12.3"
+	if err := os.WriteFile(filepath.Join(root, "m.txt"), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{root: root, jobs: make(chan struct{}, 1)}
+	get := httptest.NewRecorder()
+	s.GetAggregate(get, httptest.NewRequest(http.MethodGet, "/aggregate?file=m.txt", nil))
+	post := httptest.NewRecorder()
+	s.PostAggregate(post, httptest.NewRequest(http.MethodPost, "/aggregate", strings.NewReader(data)))
+
+	if get.Code != http.StatusOK || post.Code != http.StatusOK {
+		t.Fatalf("GET %d %s, POST %d %s", get.Code, get.Body, post.Code, post.Body)
+	}
+	if !strings.Contains(get.Body.String(), "Last=-12.3/-12.3/-12.3\n") || get.Body.String() != post.Body.String() {
+		t.Errorf("GET gives\n%s\nPOST\n%s", get.Body, post.Body)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"brc/pkg"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"syscall"
+	"time"
+)
+
+const (
+	SEARCH_GRID     = "grid"
+	SEARCH_ADAPTIVE = "adaptive"
+
+	TUNE_ROUNDS  = 3
+	TUNE_EPSILON = 0.02 // an adaptive step has to be this much faster to be taken
+)
+
+// tuneParam is one searched Config field, set is applied in param order so later ones can depend on earlier.
+type tuneParam struct {
+	name   string
+	values []int
+	set    func(c *Config, v int)
+	grid   bool // part of the full grid, the others keep their defaults there
+}
+
+// tuneParams lists the values searched for each Config field on this machine.
+func tuneParams() []tuneParam {
+	cpus := runtime.NumCPU()
+	workers := []int{cpus/2 + 1, cpus}
+	for w := 1; w < cpus; w *= 2 {
+		workers = append(workers, w)
+	}
+	slices.Sort(workers)
+	workers = slices.Compact(workers)
+
+	return []tuneParam{
+		{"workers", workers, func(c *Config, v int) { c.Workers = v }, true},
+		{"read_buf", []int{256 << 10, 1 << 20, 4 << 20, 16 << 20}, func(c *Config, v int) { c.ReadBuf = v }, true},
+		// as a fraction of read_buf, so it stays proportional to the block size
+		{"hkv_batch", []int{64, 16, 4}, func(c *Config, v int) { c.HKVBatch = max(1, c.ReadBuf/v) }, true},
+		{"block_chan_buf", []int{4, 16, 96}, func(c *Config, v int) { c.BlockChanBuf = v }, false},
+		{"batch_chan_buf", []int{2, 10, 32}, func(c *Config, v int) { c.BatchChanBuf = v }, false},
+		{"table", []int{0, 1, 2}, func(c *Config, v int) { c.Table = []string{pkg.TABLE_MAP, pkg.TABLE_OPEN, pkg.TABLE_COLUMNS}[v] }, false},
+		{"pipeline", []int{0, 1, 2}, func(c *Config, v int) {
+			c.Pipeline = []string{pkg.PIPELINE_STAGED, pkg.PIPELINE_FUSED, pkg.PIPELINE_PARTITIONED}[v]
+		}, false},
+	}
+}
+
+// tuner times pipeline runs over a sample, remembering every Config it tried.
+type tuner struct {
+	ctx    context.Context
+	sample []byte
+	runs   int
+	params []tuneParam
+	base   Config
+
+	tried map[Config]time.Duration
+	best  Config
+	bestT *Timings
+}
+
+// Tune implements the 'tune' command: it times the pipeline over a sample of a file for a grid or an adaptive
+// (one parameter at a time) search of Config values, reports the fastest and writes it for '-config'.
+// It returns the exit code.
+func Tune(args []string) int {
+	flags := flag.NewFlagSet("tune", flag.ExitOnError)
+	flagFile := flags.String("file", "../../data/measurements.txt", "1brc file")
+	flagPercent := flags.Int("percent", 10, "% of file the sample covers [1, 100]")
+	flagRuns := flags.Int("runs", 3, "runs per config, the fastest counts")
+	flagSearch := flags.String("search", SEARCH_ADAPTIVE, "adaptive: one parameter at a time; grid: every workers/read_buf/hkv_batch combination")
+	flagOut := flags.String("out", "tune.json", "config file written for '-config'")
+	flags.Parse(args)
+	if *flagSearch != SEARCH_GRID && *flagSearch != SEARCH_ADAPTIVE {
+		return Fail(fmt.Errorf("%w: unknown search '%s'", ErrUsage, *flagSearch))
+	}
+	if *flagPercent < 1 || *flagPercent > 100 {
+		return Fail(fmt.Errorf("%w: percent %d not in [1, 100]", ErrUsage, *flagPercent))
+	}
+
+	data, size, err := pkg.MMapFile(*flagFile)
+	if err != nil {
+		return Fail(fmt.Errorf("%w: %w", ErrIO, err))
+	}
+	start, end := pkg.LineRange(data, 0, size*int64(*flagPercent)/100)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	tn := &tuner{
+		ctx:    ctx,
+		sample: data[start:end],
+		runs:   max(1, *flagRuns),
+		params: tuneParams(),
+		base:   pkg.DefaultConfig(end - start),
+		tried:  map[Config]time.Duration{},
+	}
+	log.Printf("tuning on %d bytes of '%s', %s search", end-start, *flagFile, *flagSearch)
+
+	// the first run pages the sample in, so it is not held against the default config
+	if _, err := Aggregate(ctx, tn.base, tn.sample, 0, &Timings{}); err != nil {
+		return Fail(err)
+	}
+	dDefault, err := tn.time(tn.base)
+	if err != nil {
+		return Fail(err)
+	}
+
+	if *flagSearch == SEARCH_GRID {
+		err = tn.grid()
+	} else {
+		err = tn.adaptive()
+	}
+	if err != nil {
+		return Fail(err)
+	}
+
+	dBest := tn.tried[tn.best]
+	fmt.Printf("tried %d configs\n", len(tn.tried))
+	fmt.Printf("default: %v %s\n", dDefault, describe(tn.base))
+	fmt.Printf("fastest: %v %s (%.2fx)\n", dBest, describe(tn.best), float64(dDefault)/float64(dBest))
+	for _, p := range tn.bestT.Phases()[:4] {
+		fmt.Printf("  %s: %v\n", p.Name, p.Duration)
+	}
+
+	if err := tn.best.Save(*flagOut); err != nil {
+		return Fail(fmt.Errorf("%w: %w", ErrOutput, err))
+	}
+	fmt.Printf("wrote '%s', use it with '-config %s'\n", *flagOut, *flagOut)
+	return 0
+}
+
+// time returns the fastest of tn.runs runs of cfg over the sample, configs already tried are not rerun.
+func (tn *tuner) time(cfg Config) (time.Duration, error) {
+	if d, ok := tn.tried[cfg]; ok {
+		return d, nil
+	}
+	var best time.Duration
+	var bestT *Timings
+	for range tn.runs {
+		t := &pkg.Timings{Start: time.Now(), Workers: cfg.Workers}
+		if _, err := Aggregate(tn.ctx, cfg, tn.sample, 0, t); err != nil {
+			return 0, err
+		}
+		if tn.ctx.Err() != nil {
+			return 0, fmt.Errorf("tune: %w", context.Cause(tn.ctx))
+		}
+		if d := time.Since(t.Start); bestT == nil || d < best {
+			best, bestT = d, t
+		}
+	}
+	tn.tried[cfg] = best
+	if tn.bestT == nil || best < tn.tried[tn.best] {
+		tn.best, tn.bestT = cfg, bestT
+	}
+	log.Printf("%v %s", best, describe(cfg))
+	return best, nil
+}
+
+// grid times every combination of the grid params, the others keep their defaults.
+func (tn *tuner) grid() error {
+	var grid []tuneParam
+	for _, p := range tn.params {
+		if p.grid {
+			grid = append(grid, p)
+		}
+	}
+
+	idx := make([]int, len(grid))
+	for {
+		cfg := tn.base
+		for i, p := range grid {
+			p.set(&cfg, p.values[idx[i]])
+		}
+		if _, err := tn.time(cfg); err != nil {
+			return err
+		}
+
+		// next combination, odometer style
+		i := len(idx) - 1
+		for ; i >= 0; i-- {
+			idx[i]++
+			if idx[i] < len(grid[i].values) {
+				break
+			}
+			idx[i] = 0
+		}
+		if i < 0 {
+			return nil
+		}
+	}
+}
+
+// adaptive starts at the default config and sweeps one param at a time, keeping a value only if it is clearly
+// faster, until a round changes nothing or TUNE_ROUNDS are done.
+func (tn *tuner) adaptive() error {
+	cur := tn.base
+	dCur, err := tn.time(cur)
+	if err != nil {
+		return err
+	}
+	for round := 0; round < TUNE_ROUNDS; round++ {
+		changed := false
+		for _, p := range tn.params {
+			for _, v := range p.values {
+				cfg := cur
+				p.set(&cfg, v)
+				if p.name == "read_buf" {
+					// keep the rows per batch proportional
+					cfg.HKVBatch = max(1, cur.HKVBatch*v/cur.ReadBuf)
+				}
+				d, err := tn.time(cfg)
+				if err != nil {
+					return err
+				}
+				if float64(d) < float64(dCur)*(1-TUNE_EPSILON) {
+					cur, dCur, changed = cfg, d, true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+	}
+	return nil
+}
+
+func describe(c Config) string {
+	return fmt.Sprintf("workers=%d read_buf=%d hkv_batch=%d block_chan_buf=%d batch_chan_buf=%d table=%s pipeline=%s",
+		c.Workers, c.ReadBuf, c.HKVBatch, c.BlockChanBuf, c.BatchChanBuf, c.Table, c.Pipeline)
+}
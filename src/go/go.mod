@@ -5,6 +5,7 @@ go 1.22.0
 require (
 	github.com/zeebo/xxh3 v1.0.2
 	golang.org/x/exp v0.0.0-20240318143956-a85f2c67cd81
+	golang.org/x/sync v0.7.0
 )
 
 require (
@@ -17,10 +18,10 @@ require (
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/image v0.11.0 // indirect
-	golang.org/x/text v0.12.0 // indirect
 )
 
 require (
-	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9
+	golang.org/x/text v0.12.0
 	gonum.org/v1/plot v0.14.0
 )
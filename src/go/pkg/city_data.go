@@ -1,9 +1,17 @@
 package pkg
 
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type CityData struct {
 	Min, Sum, Max int
 	Count         int
 	HK            HK
+	Next          *CityData // the next station with the same HK.Hash, see OutputMap
 }
 
 func (cd *CityData) Merge(other *CityData) {
@@ -31,11 +39,46 @@ func (cd *CityData) MergeValue(value int) {
 type HashKey = uint
 
 type HK struct {
-	Hash HashKey
-	Key  []byte
+	Hash   HashKey
+	Key    []byte
+	Window int64 // window start in unix seconds, only set with -window
+}
+
+// Equal reports whether hk and other are the same station (and window), not just the same hash.
+func (hk *HK) Equal(other *HK) bool {
+	return hk.Hash == other.Hash && hk.Window == other.Window && bytes.Equal(hk.Key, other.Key)
 }
 
 type HKV struct {
 	HK
 	Value int
 }
+
+// ParsePartial parses a '<Name>=<Min>/<Sum>/<Count>/<Max>' line as written by the partial output format.
+// The returned HK holds the name only, hashing is left to the caller.
+func ParsePartial(line []byte) (CityData, error) {
+	i := bytes.LastIndexByte(line, '=')
+	if i < 0 {
+		return CityData{}, fmt.Errorf("parse partial '%s': missing '='", line)
+	}
+	fields := strings.Split(string(line[i+1:]), "/")
+	if len(fields) != 4 {
+		return CityData{}, fmt.Errorf("parse partial '%s': expected 4 values", line)
+	}
+
+	cd := CityData{HK: HK{Key: line[:i]}}
+	var err error
+	if cd.Min, err = ParseIndec(fields[0]); err != nil {
+		return CityData{}, err
+	}
+	if cd.Sum, err = ParseIndec(fields[1]); err != nil {
+		return CityData{}, err
+	}
+	if cd.Count, err = strconv.Atoi(fields[2]); err != nil {
+		return CityData{}, fmt.Errorf("parse partial '%s': %w", line, err)
+	}
+	if cd.Max, err = ParseIndec(fields[3]); err != nil {
+		return CityData{}, err
+	}
+	return cd, nil
+}
@@ -0,0 +1,82 @@
+package pkg
+
+import "math/bits"
+
+const (
+	TABLE_MAP     = "map"     // Go's map[HashKey]*CityData
+	TABLE_OPEN    = "open"    // CityMap
+	TABLE_COLUMNS = "columns" // Columns
+)
+
+// CityMap is a power-of-two sized, linear probing hash table storing CityData inline.
+// Slots are keyed by the precomputed HK.Hash, the key bytes (and window) are compared so colliding hashes
+// still get slots of their own. It grows once half full. Keys are interned on insertion.
+type CityMap struct {
+	slots    []CityData // Count == 0 marks a free slot
+	mask     uint
+	len      int
+	interner *Interner
+}
+
+// NewCityMap returns a CityMap holding at least size stations before it grows, interning its keys in interner.
+func NewCityMap(size int, interner *Interner) *CityMap {
+	n := 1 << bits.Len(uint(max(8, 2*size-1)))
+	return &CityMap{slots: make([]CityData, n), mask: uint(n - 1), interner: interner}
+}
+
+func (m *CityMap) Len() int {
+	return m.len
+}
+
+// slot returns the slot of hk, a free one if it is not in m yet.
+func (m *CityMap) slot(hk *HK) *CityData {
+	for i := hk.Hash & m.mask; ; i = (i + 1) & m.mask {
+		cd := &m.slots[i]
+		if cd.Count == 0 || cd.HK.Equal(hk) {
+			return cd
+		}
+	}
+}
+
+// Add aggregates one row.
+func (m *CityMap) Add(hk *HK, val int) {
+	cd := m.slot(hk)
+	if cd.Count == 0 {
+		*cd = CityData{Min: val, Sum: val, Max: val, Count: 1, HK: HK{Hash: hk.Hash, Key: m.interner.Intern(hk.Hash, hk.Key), Window: hk.Window}}
+		m.inserted()
+		return
+	}
+	cd.Min = min(cd.Min, val)
+	cd.Max = max(cd.Max, val)
+	cd.Sum += val
+	cd.Count++
+}
+
+func (m *CityMap) inserted() {
+	m.len++
+	if 2*m.len <= len(m.slots) {
+		return
+	}
+	old := m.slots
+	m.slots = make([]CityData, 2*len(old))
+	m.mask = uint(len(m.slots) - 1)
+	for i := range old {
+		if old[i].Count == 0 {
+			continue
+		}
+		j := old[i].HK.Hash & m.mask
+		for m.slots[j].Count != 0 {
+			j = (j + 1) & m.mask
+		}
+		m.slots[j] = old[i]
+	}
+}
+
+// Each calls fn for every station in slot order, fn may modify the CityData in place.
+func (m *CityMap) Each(fn func(cd *CityData)) {
+	for i := range m.slots {
+		if m.slots[i].Count != 0 {
+			fn(&m.slots[i])
+		}
+	}
+}
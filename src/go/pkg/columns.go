@@ -0,0 +1,121 @@
+package pkg
+
+import (
+	"math"
+	"sync"
+)
+
+// Dictionary assigns every station a dense id shared by all the Columns of a run.
+type Dictionary struct {
+	mu       sync.Mutex
+	ids      map[HashKey][]int32 // stations sharing a hash keep several ids
+	keys     []HK
+	interner *Interner
+}
+
+// NewDictionary returns an empty Dictionary interning its keys in interner.
+func NewDictionary(size int, interner *Interner) *Dictionary {
+	return &Dictionary{ids: make(map[HashKey][]int32, size), keys: make([]HK, 0, size), interner: interner}
+}
+
+// ID returns the id and interned key of hk, assigning the next id to a new station.
+func (d *Dictionary) ID(hk *HK) (int32, HK) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, id := range d.ids[hk.Hash] {
+		if d.keys[id].Equal(hk) {
+			return id, d.keys[id]
+		}
+	}
+	id := int32(len(d.keys))
+	d.keys = append(d.keys, HK{Hash: hk.Hash, Key: d.interner.Intern(hk.Hash, hk.Key), Window: hk.Window})
+	d.ids[hk.Hash] = append(d.ids[hk.Hash], id)
+	return id, d.keys[id]
+}
+
+// Columns aggregates rows as a struct of arrays indexed by Dictionary id, so merging Columns is an element-wise
+// reduction. A worker looks ids up in its own index and only locks the Dictionary for stations new to it.
+type Columns struct {
+	dict  *Dictionary
+	index map[HashKey]int32
+	keys  []HK // the worker's copy of the stations in its index, by id
+
+	Min, Max []int32 // math.MaxInt32 and math.MinInt32 without rows
+	Sum      []int
+	Count    []int
+}
+
+// NewColumns returns empty Columns, one per worker, all sharing dict.
+func NewColumns(dict *Dictionary, size int) *Columns {
+	return &Columns{dict: dict, index: make(map[HashKey]int32, size)}
+}
+
+func (c *Columns) Len() int {
+	return len(c.Count)
+}
+
+// id returns the id of hk, growing the columns to hold it.
+func (c *Columns) id(hk *HK) int32 {
+	if id, ok := c.index[hk.Hash]; ok && c.keys[id].Equal(hk) {
+		return id
+	}
+	// new to this worker, or colliding with a station it indexed first
+	id, key := c.dict.ID(hk)
+	if _, ok := c.index[hk.Hash]; !ok {
+		c.index[hk.Hash] = id
+	}
+	c.grow(int(id) + 1)
+	c.keys[id] = key
+	return id
+}
+
+func (c *Columns) grow(n int) {
+	for len(c.Count) < n {
+		c.keys = append(c.keys, HK{})
+		c.Min = append(c.Min, math.MaxInt32)
+		c.Max = append(c.Max, math.MinInt32)
+		c.Sum = append(c.Sum, 0)
+		c.Count = append(c.Count, 0)
+	}
+}
+
+// AddBatch aggregates a batch.
+func (c *Columns) AddBatch(batch []HKV) {
+	for i := range batch {
+		id := c.id(&batch[i].HK)
+		val := batch[i].Value
+		c.Min[id] = min(c.Min[id], int32(val))
+		c.Max[id] = max(c.Max[id], int32(val))
+		c.Sum[id] += val
+		c.Count[id]++
+	}
+}
+
+// Merge adds other, a worker's Columns over the same Dictionary, element by element.
+func (c *Columns) Merge(other *Columns) {
+	c.grow(other.Len())
+	n := other.Len()
+	mins, maxs, sums, counts := c.Min[:n], c.Max[:n], c.Sum[:n], c.Count[:n]
+	for i := range counts {
+		mins[i] = min(mins[i], other.Min[i])
+		maxs[i] = max(maxs[i], other.Max[i])
+		sums[i] += other.Sum[i]
+		counts[i] += other.Count[i]
+	}
+}
+
+// Each calls fn for every station with rows, as CityData allocated together in one slice.
+func (c *Columns) Each(fn func(cd *CityData)) {
+	c.dict.mu.Lock()
+	keys := c.dict.keys
+	c.dict.mu.Unlock()
+
+	cds := make([]CityData, c.Len())
+	for i := range cds {
+		if c.Count[i] == 0 {
+			continue
+		}
+		cds[i] = CityData{Min: int(c.Min[i]), Sum: c.Sum[i], Max: int(c.Max[i]), Count: c.Count[i], HK: keys[i]}
+		fn(&cds[i])
+	}
+}
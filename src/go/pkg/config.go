@@ -0,0 +1,144 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+const (
+	MAX_READ_BUF = 1024 * 1024 * 16
+	MIN_READ_BUF = 1024 * 64
+
+	MAX_BLOCK_CHAN_BUF = 64 + 32
+
+	STATIONS = 41_343
+)
+
+const (
+	PIPELINE_STAGED      = "staged"      // ParseBlocks sends batches to MapData
+	PIPELINE_FUSED       = "fused"       // FuseBlocks parses straight into the tables
+	PIPELINE_PARTITIONED = "partitioned" // PartitionBlocks routes rows to the one shard owning their station
+)
+
+// Config holds the pipeline's concurrency and buffer sizes, zero fields are filled in by DefaultConfig.
+type Config struct {
+	Workers      int    `json:"workers"`                // parse and map goroutines
+	ReadBuf      int    `json:"read_buf"`               // max block size in bytes
+	BlockChanBuf int    `json:"block_chan_buf"`         // blocks buffered per worker
+	BatchChanBuf int    `json:"batch_chan_buf"`         // batches buffered per worker
+	HKVBatch     int    `json:"hkv_batch"`              // rows per batch
+	MapSize      int    `json:"map_size"`               // initial capacity of the station maps
+	Table        string `json:"table,omitempty"`        // TABLE_MAP, TABLE_OPEN or TABLE_COLUMNS
+	Pipeline     string `json:"pipeline,omitempty"`     // PIPELINE_STAGED, PIPELINE_FUSED or PIPELINE_PARTITIONED
+	Parser       string `json:"parser,omitempty"`       // a name in PARSERS
+	Hash         string `json:"hash,omitempty"`         // a name in HASHERS
+	Stations     string `json:"stations,omitempty"`     // known stations file, see LoadStations
+	CheckParser  bool   `json:"check_parser,omitempty"` // cross-check Parser against the scalar one
+	Release      bool   `json:"release,omitempty"`      // drop processed parts of a mapped file from memory
+	Normalize    string `json:"normalize,omitempty"`    // NORMALIZE_NFC, NORMALIZE_NFKC or NORMALIZE_CASEFOLD, empty to keep names as is
+
+	Perfect    *PerfectHash `json:"-"` // built from Stations with Hash, nil to use the general tables only
+	Releaser   *Releaser    `json:"-"` // set by Aggregate if Release
+	Normalizer *Normalizer  `json:"-"` // set by Aggregate if Normalize
+	Interner   *Interner    `json:"-"` // set by Aggregate, shared by the tables of the run
+	Blocks     *BlockPool   `json:"-"` // the buffers of ReadStream, nil when reading a file
+}
+
+// DefaultConfig sizes the pipeline for this machine and an input of size bytes, size <= 0 if unknown.
+// The maxima are what was tuned on an i7-12700KF (20 threads) for the 1B rows file.
+func DefaultConfig(size int64) Config {
+	cfg := Config{
+		Workers:      max(1, runtime.NumCPU()/2+1),
+		ReadBuf:      MAX_READ_BUF,
+		BatchChanBuf: 10,
+		MapSize:      STATIONS,
+		Table:        TABLE_MAP,
+		Pipeline:     PIPELINE_STAGED,
+		Parser:       PARSER_SWAR,
+		Hash:         HASH_XXH3,
+	}
+	if size > 0 {
+		// aim for a few blocks per worker so small inputs still spread over all of them
+		cfg.ReadBuf = int(min(MAX_READ_BUF, max(MIN_READ_BUF, size/int64(4*cfg.Workers))))
+	}
+	cfg.BlockChanBuf = MAX_BLOCK_CHAN_BUF
+	if size > 0 {
+		blocks := size/int64(cfg.ReadBuf) + 1
+		cfg.BlockChanBuf = int(min(MAX_BLOCK_CHAN_BUF, blocks/int64(cfg.Workers)+1))
+	}
+	cfg.HKVBatch = cfg.ReadBuf / 16
+	return cfg
+}
+
+// Override returns c with every non-zero field of o applied.
+func (c Config) Override(o Config) Config {
+	if o.Workers > 0 {
+		c.Workers = o.Workers
+	}
+	if o.ReadBuf > 0 {
+		c.ReadBuf = o.ReadBuf
+		if o.HKVBatch == 0 {
+			c.HKVBatch = o.ReadBuf / 16
+		}
+	}
+	if o.BlockChanBuf > 0 {
+		c.BlockChanBuf = o.BlockChanBuf
+	}
+	if o.BatchChanBuf > 0 {
+		c.BatchChanBuf = o.BatchChanBuf
+	}
+	if o.HKVBatch > 0 {
+		c.HKVBatch = o.HKVBatch
+	}
+	if o.MapSize > 0 {
+		c.MapSize = o.MapSize
+	}
+	if o.Table != "" {
+		c.Table = o.Table
+	}
+	if o.Pipeline != "" {
+		c.Pipeline = o.Pipeline
+	}
+	if o.Parser != "" {
+		c.Parser = o.Parser
+	}
+	if o.Hash != "" {
+		c.Hash = o.Hash
+	}
+	if o.Stations != "" {
+		c.Stations = o.Stations
+	}
+	if o.Normalize != "" {
+		c.Normalize = o.Normalize
+	}
+	if o.Perfect != nil {
+		c.Perfect = o.Perfect
+	}
+	c.CheckParser = c.CheckParser || o.CheckParser
+	c.Release = c.Release || o.Release
+	return c
+}
+
+// LoadConfig reads a config file as written by Save, e.g. by the 'tune' command.
+func LoadConfig(name string) (Config, error) {
+	var c Config
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return c, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("load config '%s': %w", name, err)
+	}
+	return c, nil
+}
+
+// Save writes c as indented JSON to name.
+func (c Config) Save(name string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,125 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+)
+
+// DELIM_WINDOW is the number of bytes findDelims looks at.
+const DELIM_WINDOW = 32
+
+const (
+	SWAR_LOWS    = 0x7F7F7F7F7F7F7F7F
+	SWAR_NEWLINE = '\n' * SWAR_ONES
+)
+
+// findDelims returns bitmasks of the ';' and '\n' bytes of a window, bit i for byte i.
+// The architecture files replace it by an assembly version when the CPU supports one.
+var findDelims = findDelimsGeneric
+
+// DELIMS_ACCEL names the findDelims in use.
+var DELIMS_ACCEL = "generic"
+
+func findDelimsGeneric(w *[DELIM_WINDOW]byte) (semis, newlines uint32) {
+	for i := 0; i < DELIM_WINDOW; i += 8 {
+		word := binary.LittleEndian.Uint64(w[i:])
+		semis |= byteMask(word^SWAR_SEMIS) << i
+		newlines |= byteMask(word^SWAR_NEWLINE) << i
+	}
+	return semis, newlines
+}
+
+// byteMask has bit i set for every zero byte i of x. Unlike the test in semicolon it is exact,
+// then gathers the high bits into the low byte with a multiplication that cannot carry.
+func byteMask(x uint64) uint32 {
+	zeros := ^(((x & SWAR_LOWS) + SWAR_LOWS) | x | SWAR_LOWS)
+	return uint32(((zeros >> 7) * 0x0102040810204080) >> 56)
+}
+
+// ParseBlockSIMD is ParseBlockSWAR finding ';' with findDelims a window at a time.
+// A '\n' before the next ';' is a row without temperature, which the other parsers do not notice.
+func ParseBlockSIMD(block []byte, out []HKV, hash Hasher) ([]HKV, int, error) {
+	return parseBlockSIMD(block, out, hash, false)
+}
+
+// ParseBlockSIMDWord is ParseBlockSIMD keying rows by HashWord, which hash must be.
+func ParseBlockSIMDWord(block []byte, out []HKV, hash Hasher) ([]HKV, int, error) {
+	return parseBlockSIMD(block, out, hash, true)
+}
+
+func parseBlockSIMD(block []byte, out []HKV, hash Hasher, word bool) ([]HKV, int, error) {
+	base := -DELIM_WINDOW // no window loaded yet
+	var semis, newlines uint32
+	i := 0
+	for i < len(block) && len(out) < cap(out) {
+		start := i
+		for {
+			if i >= base+DELIM_WINDOW {
+				if i+DELIM_WINDOW > len(block) {
+					var n int
+					var err error
+					out, n, err = parseBlockSWAR(block[start:], out, hash, word)
+					return out, start + n, err
+				}
+				base = i
+				semis, newlines = findDelims((*[DELIM_WINDOW]byte)(block[i:]))
+			}
+			s, nl := semis>>(i-base), newlines>>(i-base)
+			if nl != 0 && bits.TrailingZeros32(nl) < bits.TrailingZeros32(s) {
+				return out, i, ErrMalformed
+			}
+			if s != 0 {
+				i += bits.TrailingZeros32(s)
+				break
+			}
+			i = base + DELIM_WINDOW
+		}
+		key := block[start:i]
+		i++
+		if i+8 > len(block) {
+			var n int
+			var err error
+			out, n, err = ParseBlock(block[start:], out, hash)
+			return out, start + n, err
+		}
+
+		val, n, ok := decodeTemp(binary.LittleEndian.Uint64(block[i:]))
+		if !ok {
+			return out, i, ErrMalformed
+		}
+		var h HashKey
+		if word {
+			h = loadWordHash(block, start, len(key))
+		} else {
+			h = hash(key)
+		}
+		out = append(out, HKV{HK: HK{Hash: h, Key: key}, Value: val})
+		i = skipRow(block, i+n)
+	}
+	return out, i, nil
+}
+
+// loadWordHash is HashWord of block[start:start+n] loading its first and last 8 bytes, at least 8 bytes must follow it.
+func loadWordHash(block []byte, start, n int) HashKey {
+	first := binary.LittleEndian.Uint64(block[start:])
+	if n < 8 {
+		first &= 1<<(8*n) - 1
+		return wordHash(first, first, n)
+	}
+	return wordHash(first, binary.LittleEndian.Uint64(block[start+n-8:]), n)
+}
+
+// CheckDelims compares findDelims with findDelimsGeneric on every window of block.
+func CheckDelims(block []byte) error {
+	for i := 0; i+DELIM_WINDOW <= len(block); i++ {
+		w := (*[DELIM_WINDOW]byte)(block[i:])
+		semis, newlines := findDelims(w)
+		wantSemis, wantNewlines := findDelimsGeneric(w)
+		if semis != wantSemis || newlines != wantNewlines {
+			return fmt.Errorf("%w: %s delimiters at offset %d are %032b/%032b, generic %032b/%032b",
+				ErrParserMismatch, DELIMS_ACCEL, i, semis, newlines, wantSemis, wantNewlines)
+		}
+	}
+	return nil
+}
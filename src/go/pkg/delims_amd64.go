@@ -0,0 +1,13 @@
+package pkg
+
+import "github.com/klauspost/cpuid/v2"
+
+//go:noescape
+func findDelimsAVX2(w *[DELIM_WINDOW]byte) (semis, newlines uint32)
+
+func init() {
+	if cpuid.CPU.Supports(cpuid.AVX2) {
+		findDelims = findDelimsAVX2
+		DELIMS_ACCEL = "avx2"
+	}
+}
@@ -0,0 +1,23 @@
+#include "textflag.h"
+
+// func findDelimsAVX2(w *[32]byte) (semis, newlines uint32)
+TEXT ·findDelimsAVX2(SB), NOSPLIT, $0-16
+	MOVQ w+0(FP), AX
+	VMOVDQU (AX), Y0
+
+	MOVQ $0x3b, BX // ';'
+	MOVQ BX, X1
+	VPBROADCASTB X1, Y1
+	VPCMPEQB Y1, Y0, Y2
+	VPMOVMSKB Y2, CX
+	MOVL CX, semis+8(FP)
+
+	MOVQ $0x0a, BX // '\n'
+	MOVQ BX, X1
+	VPBROADCASTB X1, Y1
+	VPCMPEQB Y1, Y0, Y2
+	VPMOVMSKB Y2, CX
+	MOVL CX, newlines+12(FP)
+
+	VZEROUPPER
+	RET
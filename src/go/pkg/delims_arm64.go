@@ -0,0 +1,13 @@
+package pkg
+
+import "github.com/klauspost/cpuid/v2"
+
+//go:noescape
+func findDelimsNEON(w *[DELIM_WINDOW]byte) (semis, newlines uint32)
+
+func init() {
+	if cpuid.CPU.Supports(cpuid.ASIMD) {
+		findDelims = findDelimsNEON
+		DELIMS_ACCEL = "neon"
+	}
+}
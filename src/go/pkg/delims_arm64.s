@@ -0,0 +1,36 @@
+#include "textflag.h"
+
+// func findDelimsNEON(w *[32]byte) (semis, newlines uint32)
+// NEON has no movemask: matches are ANDed with per byte bit weights and summed pairwise into one bit per byte.
+TEXT ·findDelimsNEON(SB), NOSPLIT, $0-16
+	MOVD w+0(FP), R0
+	VLD1 (R0), [V0.B16, V1.B16]
+
+	MOVD $0x8040201008040201, R1
+	VMOV R1, V4.D[0]
+	VMOV R1, V4.D[1]
+
+	MOVD $0x3b, R2 // ';'
+	VDUP R2, V2.B16
+	VCMEQ V2.B16, V0.B16, V5.B16
+	VCMEQ V2.B16, V1.B16, V6.B16
+	VAND V4.B16, V5.B16, V5.B16
+	VAND V4.B16, V6.B16, V6.B16
+	VADDP V6.B16, V5.B16, V7.B16
+	VADDP V7.B16, V7.B16, V7.B16
+	VADDP V7.B16, V7.B16, V7.B16
+	VMOV V7.S[0], R3
+	MOVW R3, semis+8(FP)
+
+	MOVD $0x0a, R2 // '\n'
+	VDUP R2, V2.B16
+	VCMEQ V2.B16, V0.B16, V5.B16
+	VCMEQ V2.B16, V1.B16, V6.B16
+	VAND V4.B16, V5.B16, V5.B16
+	VAND V4.B16, V6.B16, V6.B16
+	VADDP V6.B16, V5.B16, V7.B16
+	VADDP V7.B16, V7.B16, V7.B16
+	VADDP V7.B16, V7.B16, V7.B16
+	VMOV V7.S[0], R3
+	MOVW R3, newlines+12(FP)
+	RET
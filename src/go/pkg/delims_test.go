@@ -0,0 +1,70 @@
+package pkg
+
+import (
+	"math/rand/v2"
+	"testing"
+)
+
+// naiveDelims is findDelims one byte at a time.
+func naiveDelims(w *[DELIM_WINDOW]byte) (semis, newlines uint32) {
+	for i, c := range w {
+		switch c {
+		case ';':
+			semis |= 1 << i
+		case '\n':
+			newlines |= 1 << i
+		}
+	}
+	return semis, newlines
+}
+
+func checkWindow(t *testing.T, w *[DELIM_WINDOW]byte) {
+	t.Helper()
+	wantSemis, wantNewlines := naiveDelims(w)
+	if semis, newlines := findDelimsGeneric(w); semis != wantSemis || newlines != wantNewlines {
+		t.Fatalf("generic delimiters of %q are %032b/%032b, want %032b/%032b", w, semis, newlines, wantSemis, wantNewlines)
+	}
+	if semis, newlines := findDelims(w); semis != wantSemis || newlines != wantNewlines {
+		t.Fatalf("%s delimiters of %q are %032b/%032b, want %032b/%032b", DELIMS_ACCEL, w, semis, newlines, wantSemis, wantNewlines)
+	}
+}
+
+// TestFindDelims compares findDelims, whichever the CPU selected, and findDelimsGeneric with a byte by byte scan.
+func TestFindDelims(t *testing.T) {
+	t.Logf("findDelims is %s", DELIMS_ACCEL)
+	// the delimiters, bytes one bit away from them, and bytes with the high bit set
+	near := []byte{';', '\n', ';' ^ 1, ';' ^ 2, '\n' ^ 1, '\n' ^ 2, ';' | 0x80, '\n' | 0x80, 0, 0x7F, 0x80, 0xFF}
+
+	var w [DELIM_WINDOW]byte
+	for _, fill := range near {
+		for i := range w {
+			w[i] = fill
+		}
+		checkWindow(t, &w)
+		for i := range w {
+			for _, c := range near {
+				w[i] = c
+				checkWindow(t, &w)
+			}
+			w[i] = fill
+		}
+	}
+	for c := 0x80; c <= 0xFF; c++ {
+		for i := range w {
+			w[i] = byte(c)
+		}
+		checkWindow(t, &w)
+	}
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 100000 {
+		for i := range w {
+			if rng.IntN(2) == 0 {
+				w[i] = near[rng.IntN(len(near))]
+			} else {
+				w[i] = byte(rng.Uint32())
+			}
+		}
+		checkWindow(t, &w)
+	}
+}
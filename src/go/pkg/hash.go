@@ -0,0 +1,119 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+
+	"github.com/zeebo/xxh3"
+)
+
+const (
+	HASH_XXH3   = "xxh3"   // HashXXH3
+	HASH_FNV    = "fnv"    // HashFNV
+	HASH_WYHASH = "wyhash" // HashWy
+	HASH_WORD   = "word"   // HashWord
+)
+
+// Hasher hashes a station name. The tables compare names on equal hashes, so a cheap hash only costs collisions.
+type Hasher func(key []byte) HashKey
+
+// HASHERS are the hashers selectable by name.
+var HASHERS = map[string]Hasher{
+	HASH_XXH3:   HashXXH3,
+	HASH_FNV:    HashFNV,
+	HASH_WYHASH: HashWy,
+	HASH_WORD:   HashWord,
+}
+
+// NewHasher returns the named hasher.
+func NewHasher(name string) (Hasher, error) {
+	h, ok := HASHERS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash '%s'", name)
+	}
+	return h, nil
+}
+
+func HashXXH3(key []byte) HashKey {
+	return uint(xxh3.Hash(key))
+}
+
+// HashFNV is 64 bit FNV-1a, one multiplication per byte.
+func HashFNV(key []byte) HashKey {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return uint(h)
+}
+
+const (
+	WY_P0 = 0xa0761d6478bd642f
+	WY_P1 = 0xe7037ed1a0b428db
+	WY_P2 = 0x8ebc6af09c88c6e3
+	WY_P3 = 0x589965cc75374cc3
+)
+
+// HashWy is wyhash with seed 0: keys of up to 16 bytes, most station names, take a single 128 bit multiplication.
+func HashWy(key []byte) HashKey {
+	n := len(key)
+	seed := wyMix(WY_P0, WY_P1)
+	var a, b uint64
+	switch {
+	case n >= 4 && n <= 16:
+		mid := (n >> 3) << 2
+		a = uint64(binary.LittleEndian.Uint32(key))<<32 | uint64(binary.LittleEndian.Uint32(key[mid:]))
+		b = uint64(binary.LittleEndian.Uint32(key[n-4:]))<<32 | uint64(binary.LittleEndian.Uint32(key[n-4-mid:]))
+	case n > 0 && n < 4:
+		a = uint64(key[0])<<16 | uint64(key[n>>1])<<8 | uint64(key[n-1])
+	case n > 16:
+		p := key
+		if len(p) > 48 {
+			see1, see2 := seed, seed
+			for ; len(p) > 48; p = p[48:] {
+				seed = wyMix(binary.LittleEndian.Uint64(p)^WY_P1, binary.LittleEndian.Uint64(p[8:])^seed)
+				see1 = wyMix(binary.LittleEndian.Uint64(p[16:])^WY_P2, binary.LittleEndian.Uint64(p[24:])^see1)
+				see2 = wyMix(binary.LittleEndian.Uint64(p[32:])^WY_P3, binary.LittleEndian.Uint64(p[40:])^see2)
+			}
+			seed ^= see1 ^ see2
+		}
+		for ; len(p) > 16; p = p[16:] {
+			seed = wyMix(binary.LittleEndian.Uint64(p)^WY_P1, binary.LittleEndian.Uint64(p[8:])^seed)
+		}
+		a = binary.LittleEndian.Uint64(key[n-16:])
+		b = binary.LittleEndian.Uint64(key[n-8:])
+	}
+	hi, lo := bits.Mul64(a^WY_P1, b^seed)
+	return uint(wyMix(lo^WY_P0^uint64(n), hi^WY_P1))
+}
+
+func wyMix(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+// HashWord hashes only the first and last 8 bytes and the length, two loads and a multiplication whatever the
+// name's length. Names that share both ends and their length collide, which the tables resolve by comparing them.
+// The swar and simd parsers build it from the words they load looking for ';', see WORD_PARSERS.
+func HashWord(key []byte) HashKey {
+	n := len(key)
+	var first, last uint64
+	if n >= 8 {
+		first = binary.LittleEndian.Uint64(key)
+		last = binary.LittleEndian.Uint64(key[n-8:])
+	} else {
+		for i, c := range key {
+			first |= uint64(c) << (8 * i)
+		}
+		last = first
+	}
+	return wordHash(first, last, n)
+}
+
+// wordHash is HashWord of a name of length n with the given first and last 8 bytes, zero padded if n < 8.
+func wordHash(first, last uint64, n int) HashKey {
+	h := (first ^ bits.RotateLeft64(last, 29) ^ uint64(n)) * 0x9E3779B97F4A7C15
+	return uint(h ^ h>>32)
+}
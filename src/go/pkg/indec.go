@@ -2,6 +2,8 @@ package pkg
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 func PrintIndec(i int) string {
@@ -12,3 +14,31 @@ func PrintIndec(i int) string {
 	}
 	return fmt.Sprint(sign, i/10, ".", i%10)
 }
+
+// AppendIndec appends PrintIndec(i) to dst without allocating.
+func AppendIndec(dst []byte, i int) []byte {
+	if i < 0 {
+		dst = append(dst, '-')
+		i = -i
+	}
+	dst = strconv.AppendInt(dst, int64(i/10), 10)
+	return append(dst, '.', byte('0'+i%10))
+}
+
+// ParseIndec is the inverse of PrintIndec.
+func ParseIndec(s string) (int, error) {
+	sign := 1
+	if strings.HasPrefix(s, "-") {
+		sign = -1
+		s = s[1:]
+	}
+	whole, frac, ok := strings.Cut(s, ".")
+	if !ok || len(frac) != 1 {
+		return 0, fmt.Errorf("parse indec '%s': expected one decimal", s)
+	}
+	i, err := strconv.Atoi(whole + frac)
+	if err != nil {
+		return 0, fmt.Errorf("parse indec '%s': %w", s, err)
+	}
+	return sign * i, nil
+}
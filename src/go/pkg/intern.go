@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	// ARENA_CHUNK is the size of the chunks an Arena copies names into, enough for a few thousand of them.
+	ARENA_CHUNK = 64 * 1024
+
+	// INTERN_SHARDS is the number of independently locked parts of an Interner, a power of two.
+	INTERN_SHARDS = 64
+)
+
+// Arena copies names into large chunks instead of an allocation each, the copies are never moved or freed.
+// An Arena is not safe for concurrent use.
+type Arena struct {
+	chunk []byte
+}
+
+// Intern returns a copy of key owned by the arena.
+func (a *Arena) Intern(key []byte) []byte {
+	if len(key) > cap(a.chunk)-len(a.chunk) {
+		a.chunk = make([]byte, 0, max(ARENA_CHUNK, len(key)))
+	}
+	n := len(a.chunk)
+	a.chunk = append(a.chunk, key...)
+	return a.chunk[n:len(a.chunk):len(a.chunk)]
+}
+
+// Interner holds the one copy of every station name of a run, shared by all its tables: a table interns a key
+// when it first sees the station, so its keys stay valid after the input block is reused or released, and a
+// station seen by every worker is still copied once. It is safe for concurrent use, the names are sharded by hash.
+type Interner struct {
+	shards [INTERN_SHARDS]internShard
+}
+
+type internShard struct {
+	sync.Mutex
+	keys  map[HashKey][][]byte // names sharing a hash keep a copy each
+	arena Arena
+}
+
+func NewInterner() *Interner {
+	in := &Interner{}
+	for i := range in.shards {
+		in.shards[i].keys = map[HashKey][][]byte{}
+	}
+	return in
+}
+
+// Intern returns the run's copy of key, whose hash is hash, copying it on first sight.
+func (in *Interner) Intern(hash HashKey, key []byte) []byte {
+	s := &in.shards[hash&(INTERN_SHARDS-1)]
+	s.Lock()
+	defer s.Unlock()
+	for _, k := range s.keys[hash] {
+		if bytes.Equal(k, key) {
+			return k
+		}
+	}
+	k := s.arena.Intern(key)
+	s.keys[hash] = append(s.keys[hash], k)
+	return k
+}
@@ -0,0 +1,35 @@
+package pkg
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestInterner checks that concurrent workers get the same copy of a station, and stations sharing a hash copies
+// of their own.
+func TestInterner(t *testing.T) {
+	names := testStations(1000)
+	in := NewInterner()
+	copies := make([][][]byte, 4)
+	var wg sync.WaitGroup
+	for w := range copies {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, name := range names {
+				buf := append([]byte(nil), name...)
+				copies[w] = append(copies[w], in.Intern(HashKey(len(name)), buf))
+				buf[0] = 0
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, name := range names {
+		for w := range copies {
+			if string(copies[w][i]) != string(name) || &copies[w][i][0] != &copies[0][i][0] {
+				t.Fatalf("worker %d has '%s' at %p for '%s', worker 0 %p", w, copies[w][i], copies[w][i], name, copies[0][i])
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package pkg
+
+// SnapLine moves off back to the start of the line containing it, the same way
+// the block splitter cuts a block after its last '\n'.
+func SnapLine(data []byte, off int64) int64 {
+	if off <= 0 {
+		return 0
+	}
+	if off >= int64(len(data)) {
+		return int64(len(data))
+	}
+	for ; off > 0 && data[off-1] != '\n'; off-- {
+	}
+	return off
+}
+
+// LineRange snaps the byte range [from, to) to line boundaries on both ends.
+// Adjacent byte ranges snap to the same boundary, so no row is ever in two ranges.
+func LineRange(data []byte, from, to int64) (start, end int64) {
+	return SnapLine(data, from), SnapLine(data, max(from, to))
+}
+
+// ShardRange returns the line aligned range of shard i of n (0 <= i < n).
+func ShardRange(data []byte, i, n int) (start, end int64) {
+	size := int64(len(data))
+	return LineRange(data, size*int64(i)/int64(n), size*int64(i+1)/int64(n))
+}
@@ -0,0 +1,51 @@
+package pkg
+
+import "testing"
+
+// TestLineRange snaps ranges starting and ending at 0, mid-line, on a '\n', right after it and at or past the end.
+func TestLineRange(t *testing.T) {
+	data := []byte("ab;1.0\ncd;-2.0\nef;3.0\n") // lines start at 0, 7 and 15, 22 bytes
+	for _, tc := range []struct {
+		from, to   int64
+		start, end int64
+	}{
+		{0, 0, 0, 0},
+		{0, 22, 0, 22},
+		{0, 100, 0, 22},
+		{3, 10, 0, 7},
+		{6, 14, 0, 7},    // on the '\n' ending the first and second line
+		{7, 15, 7, 15},   // right after them
+		{10, 3, 7, 7},    // to before from
+		{15, 21, 15, 15}, // mid last line
+		{21, 22, 15, 22},
+		{22, 22, 22, 22},
+		{-5, 8, 0, 7},
+	} {
+		if start, end := LineRange(data, tc.from, tc.to); start != tc.start || end != tc.end {
+			t.Errorf("LineRange(%d, %d) = %d, %d, want %d, %d", tc.from, tc.to, start, end, tc.start, tc.end)
+		}
+	}
+}
+
+// TestShardRange checks that the shards of any count cover the data without a gap or overlap, each starting at a line,
+// also when the last line has no '\n'.
+func TestShardRange(t *testing.T) {
+	for _, data := range []string{"", "a;1.0\n", "ab;1.0\ncd;-2.0\nef;3.0\n", "ab;1.0\ncd;-2.0\nef;3.0"} {
+		for n := 1; n <= len(data)+2; n++ {
+			var prev int64
+			for i := range n {
+				start, end := ShardRange([]byte(data), i, n)
+				if start != prev || end < start {
+					t.Fatalf("shard %d/%d of %q is [%d, %d), want it to start at %d", i, n, data, start, end, prev)
+				}
+				if start > 0 && start < int64(len(data)) && data[start-1] != '\n' {
+					t.Fatalf("shard %d/%d of %q starts mid-line at %d", i, n, data, start)
+				}
+				prev = end
+			}
+			if prev != int64(len(data)) {
+				t.Fatalf("%d shards of %q end at %d, want %d", n, data, prev, len(data))
+			}
+		}
+	}
+}
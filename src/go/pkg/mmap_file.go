@@ -1,3 +1,5 @@
+//go:build windows
+
 package pkg
 
 import (
@@ -35,3 +37,34 @@ func MMapFile(name string) ([]byte, int64, error) {
 	data := unsafe.Slice((*byte)(unsafe.Pointer(ptr)), size)
 	return data, size, nil
 }
+
+// MRelease drops the pages of a processed part of a mapping from the working set, reading it again faults
+// them back in from the file. VirtualUnlock does that for pages that are not locked, which it then reports.
+func MRelease(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	r, _, err := procVirtualUnlock.Call(uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)))
+	if r == 0 && err != ERROR_NOT_LOCKED {
+		return fmt.Errorf("syscall VirtualUnlock: %w", err)
+	}
+	return nil
+}
+
+const ERROR_NOT_LOCKED syscall.Errno = 158
+
+var (
+	kernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procVirtualUnlock = kernel32.NewProc("VirtualUnlock")
+)
+
+// MUnmapFile releases a mapping returned by MMapFile, data must not be used afterwards.
+func MUnmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := syscall.UnmapViewOfFile(uintptr(unsafe.Pointer(&data[0]))); err != nil {
+		return fmt.Errorf("syscall UnmapViewOfFile: %w", err)
+	}
+	return nil
+}
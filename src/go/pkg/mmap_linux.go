@@ -0,0 +1,55 @@
+//go:build linux
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func MMapFile(name string) ([]byte, int64, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, 0, fmt.Errorf("open '%s': %w", name, err)
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, 0, fmt.Errorf("stat '%s': %w", name, err)
+	}
+
+	size := fi.Size()
+	if size == 0 {
+		return nil, 0, nil
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, 0, fmt.Errorf("syscall mmap '%s': %w", name, err)
+	}
+	return data, size, nil
+}
+
+// MRelease drops the pages of a processed part of a mapping, reading it again faults them back in from the file.
+// data must start on a page boundary.
+func MRelease(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := syscall.Madvise(data, syscall.MADV_DONTNEED); err != nil {
+		return fmt.Errorf("syscall madvise: %w", err)
+	}
+	return nil
+}
+
+// MUnmapFile releases a mapping returned by MMapFile, data must not be used afterwards.
+func MUnmapFile(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := syscall.Munmap(data); err != nil {
+		return fmt.Errorf("syscall munmap: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package pkg
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	NORMALIZE_NFC      = "nfc"      // canonical composition, NFD names fold into NFC ones
+	NORMALIZE_NFKC     = "nfkc"     // compatibility composition, e.g. 'ﬁ' becomes 'fi'
+	NORMALIZE_CASEFOLD = "casefold" // full case folding then NFKC, names differing only in case fold too
+)
+
+// Normalizer canonicalizes station names before they are aggregated, so the same station spelled in different
+// normal forms is one row. It is shared by all the NameCaches of a run and counts the names it rewrote.
+type Normalizer struct {
+	Form string
+
+	mu        sync.Mutex
+	form      func(key []byte) []byte
+	arena     Arena
+	rewritten map[string]*rewrite // names that were not canonical
+}
+
+// rewrite is the canonical form of a name that was not canonical, and the rows that had the name.
+type rewrite struct {
+	key  []byte
+	rows atomic.Int64
+}
+
+// NewNormalizer returns a Normalizer to the named form.
+func NewNormalizer(name string) (*Normalizer, error) {
+	n := &Normalizer{Form: name, rewritten: map[string]*rewrite{}}
+	switch name {
+	case NORMALIZE_NFC:
+		n.form = norm.NFC.Bytes
+	case NORMALIZE_NFKC:
+		n.form = norm.NFKC.Bytes
+	case NORMALIZE_CASEFOLD:
+		fold := cases.Fold()
+		n.form = func(key []byte) []byte {
+			return norm.NFKC.Bytes(fold.Bytes(key))
+		}
+	default:
+		return nil, fmt.Errorf("unknown normalization '%s'", name)
+	}
+	return n, nil
+}
+
+// Canonical returns the canonical form of key, key itself if it already is. Unlike the rows of a NameCache it is
+// not counted as rewritten, it is meant for names that are not measurements, e.g. the known stations.
+func (n *Normalizer) Canonical(key []byte) []byte {
+	if n.isASCII(key) {
+		return key
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if c := n.form(key); string(c) != string(key) {
+		return c
+	}
+	return key
+}
+
+// canonical is Canonical for non-ASCII keys with n.mu held, it returns the rewrite of a changed key, nil if the
+// key is canonical.
+func (n *Normalizer) canonical(key []byte) *rewrite {
+	if r, ok := n.rewritten[string(key)]; ok {
+		return r
+	}
+	c := n.form(key)
+	if string(c) == string(key) {
+		return nil
+	}
+	r := &rewrite{key: n.arena.Intern(c)}
+	n.rewritten[string(key)] = r
+	return r
+}
+
+// isASCII reports whether key is ASCII and already canonical: every form leaves ASCII alone, except case folding
+// upper case letters.
+func (n *Normalizer) isASCII(key []byte) bool {
+	fold := n.Form == NORMALIZE_CASEFOLD
+	for _, c := range key {
+		if c >= utf8.RuneSelf || fold && 'A' <= c && c <= 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Merged returns the number of spellings merged into another one, the distinct spellings of every canonical name
+// in the input less one, and the rows that were rewritten. output is the aggregate of the run: a canonical name
+// with more rows in it than were rewritten to it was in the input as is too, as one more spelling.
+func (n *Normalizer) Merged(output []*CityData) (variants int, rows int64) {
+	type target struct {
+		spellings       int
+		rewritten, rows int64
+	}
+	targets := map[string]*target{}
+	n.mu.Lock()
+	for _, r := range n.rewritten {
+		t, ok := targets[string(r.key)]
+		if !ok {
+			t = &target{}
+			targets[string(r.key)] = t
+		}
+		t.spellings++
+		t.rewritten += r.rows.Load()
+		rows += r.rows.Load()
+	}
+	n.mu.Unlock()
+
+	for _, cd := range output {
+		if t, ok := targets[string(cd.HK.Key)]; ok {
+			t.rows += int64(cd.Count)
+		}
+	}
+	for _, t := range targets {
+		variants += t.spellings - 1
+		if t.rows > t.rewritten {
+			variants++
+		}
+	}
+	return variants, rows
+}
+
+// NameCache is a worker's view of a Normalizer: it remembers the canonical form of every non-ASCII name it has
+// seen, so only names new to the worker lock the Normalizer. A NameCache is not safe for concurrent use.
+type NameCache struct {
+	n       *Normalizer
+	hash    Hasher
+	names   map[string]*cachedName // nil for names that are canonical
+	touched []*cachedName          // names with rows not added to their rewrite yet
+}
+
+// cachedName counts the rows of a rewrite in a batch, so the shared counter is added to once per batch.
+type cachedName struct {
+	*rewrite
+	rows int64
+}
+
+// NewCache returns an empty NameCache rehashing with hash, one per worker.
+func (n *Normalizer) NewCache(hash Hasher) *NameCache {
+	return &NameCache{n: n, hash: hash, names: map[string]*cachedName{}}
+}
+
+// Normalize canonicalizes the names of batch in place and rehashes the rows it rewrote, with the cache's hasher
+// or, if windowed, with WindowHash and the row's window.
+func (c *NameCache) Normalize(batch []HKV, windowed bool) {
+	for i := range batch {
+		hk := &batch[i].HK
+		if c.n.isASCII(hk.Key) {
+			continue
+		}
+		name, ok := c.names[string(hk.Key)]
+		if !ok {
+			c.n.mu.Lock()
+			if r := c.n.canonical(hk.Key); r != nil {
+				name = &cachedName{rewrite: r}
+			}
+			c.n.mu.Unlock()
+			c.names[string(hk.Key)] = name
+		}
+		if name == nil {
+			continue
+		}
+		hk.Key = name.key
+		if windowed {
+			hk.Hash = WindowHash(hk.Key, hk.Window)
+		} else {
+			hk.Hash = c.hash(hk.Key)
+		}
+		if name.rows == 0 {
+			c.touched = append(c.touched, name)
+		}
+		name.rows++
+	}
+	for _, name := range c.touched {
+		name.rewrite.rows.Add(name.rows)
+		name.rows = 0
+	}
+	c.touched = c.touched[:0]
+}
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"testing"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// TestNormalizerMerged checks that Merged counts the spellings of a station beyond the first, whether the canonical
+// one is among them or not.
+func TestNormalizerMerged(t *testing.T) {
+	nfc, nfd := "Zürich", norm.NFD.String("Zürich")
+	for _, tc := range []struct {
+		form   string
+		names  []string
+		merged int
+		rows   int64
+	}{
+		{NORMALIZE_NFC, []string{nfc, nfd, nfc, nfd}, 1, 2},
+		{NORMALIZE_NFC, []string{nfd, nfd}, 0, 2},
+		{NORMALIZE_NFC, []string{nfc, "Paris"}, 0, 0},
+		{NORMALIZE_CASEFOLD, []string{"Paris", "Paris"}, 0, 2},
+		{NORMALIZE_CASEFOLD, []string{"Paris", "paris", "PARIS"}, 2, 2},
+		{NORMALIZE_CASEFOLD, []string{nfc, nfd, "ZÜRICH", "Paris"}, 2, 4},
+	} {
+		n, err := NewNormalizer(tc.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// two workers, each seeing every name
+		var output []*CityData
+		stations := map[string]*CityData{}
+		for range 2 {
+			var batch []HKV
+			for _, name := range tc.names {
+				batch = append(batch, HKV{HK: HK{Key: []byte(name)}, Value: 10})
+			}
+			n.NewCache(HashXXH3).Normalize(batch, false)
+			for i := range batch {
+				cd, ok := stations[string(batch[i].Key)]
+				if !ok {
+					cd = &CityData{HK: batch[i].HK}
+					stations[string(batch[i].Key)] = cd
+					output = append(output, cd)
+				}
+				cd.Count++
+			}
+		}
+		if merged, rows := n.Merged(output); merged != tc.merged || rows != 2*tc.rows {
+			t.Errorf("%s %q: merged %d spellings in %d rows, want %d in %d", tc.form, tc.names, merged, rows, tc.merged, 2*tc.rows)
+		}
+	}
+}
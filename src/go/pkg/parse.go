@@ -0,0 +1,170 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/xxh3"
+)
+
+// ErrMalformed is returned by the parsers on a temperature that is not made of digits, ValidateBlock tells more.
+var ErrMalformed = errors.New("malformed row")
+
+// ParseBlock appends the rows of a line aligned block to out until out is full, keyed by hash.
+// It returns the grown out and the number of bytes consumed, so a caller can flush and resume with block[n:].
+func ParseBlock(block []byte, out []HKV, hash Hasher) ([]HKV, int, error) {
+	i := 0
+	for ; i < len(block) && len(out) < cap(out); i++ {
+		start := i
+		for ; block[i] != ';'; i++ {
+		}
+		key := block[start:i]
+		i++
+		sign := 1
+		if block[i] == '-' {
+			i++
+			sign = -1
+		}
+
+		val := 0
+		for ; block[i] != '.'; i++ {
+			d := block[i] - '0'
+			if d > 9 {
+				return out, i, ErrMalformed
+			}
+			val = val*10 + int(d)
+		}
+		i++
+		d := block[i] - '0'
+		if d > 9 {
+			return out, i, ErrMalformed
+		}
+		val = val*10 + int(d)
+		out = append(out, HKV{HK: HK{Hash: hash(key), Key: key}, Value: sign * val})
+
+		for ; block[i] != '\n'; i++ {
+		}
+	}
+	return out, i, nil
+}
+
+// ParseBlockWindowed is ParseBlock for rows with a third '<RFC3339 or unix seconds>' timestamp column.
+// Each row is keyed by its station and the start of its tumbling window of the given length.
+func ParseBlockWindowed(block []byte, out []HKV, window time.Duration) ([]HKV, int, error) {
+	seconds := int64(window / time.Second)
+	i := 0
+	for ; i < len(block) && len(out) < cap(out); i++ {
+		start := i
+		for ; block[i] != ';'; i++ {
+		}
+		key := block[start:i]
+		i++
+		sign := 1
+		if block[i] == '-' {
+			i++
+			sign = -1
+		}
+
+		val := 0
+		for ; block[i] != '.'; i++ {
+			d := block[i] - '0'
+			if d > 9 {
+				return out, i, ErrMalformed
+			}
+			val = val*10 + int(d)
+		}
+		i++
+		d := block[i] - '0'
+		if d > 9 {
+			return out, i, ErrMalformed
+		}
+		val = val*10 + int(d)
+		i++
+
+		if block[i] != ';' {
+			return out, i, fmt.Errorf("parse row '%s': missing timestamp", key)
+		}
+		i++
+		start = i
+		for ; block[i] != '\n'; i++ {
+		}
+		ts, err := ParseTimestamp(block[start:i])
+		if err != nil {
+			return out, i, fmt.Errorf("parse row '%s': %w", key, err)
+		}
+		ts -= ((ts % seconds) + seconds) % seconds
+
+		out = append(out, HKV{HK: HK{Hash: WindowHash(key, ts), Key: key, Window: ts}, Value: sign * val})
+	}
+	return out, i, nil
+}
+
+// ParseTimestamp parses unix seconds or an RFC3339 time into unix seconds.
+func ParseTimestamp(b []byte) (int64, error) {
+	if ts, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+		return ts, nil
+	}
+	ts, err := time.Parse(time.RFC3339, string(b))
+	if err != nil {
+		return 0, fmt.Errorf("parse timestamp '%s': want unix seconds or RFC3339", b)
+	}
+	return ts.Unix(), nil
+}
+
+// ParseWindow parses a window length such as '15m', '1h' or '1d'.
+func ParseWindow(s string) (time.Duration, error) {
+	var window time.Duration
+	var err error
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		window, err = time.ParseDuration(s)
+	}
+	if err != nil || window < time.Second || window%time.Second != 0 {
+		return 0, fmt.Errorf("parse window '%s': want a whole number of seconds like '1h' or '1d'", s)
+	}
+	return window, nil
+}
+
+// WindowHash hashes a station within a time window, so every window aggregates separately.
+func WindowHash(key []byte, window int64) HashKey {
+	return uint(xxh3.HashSeed(key, uint64(window)))
+}
+
+// ValidateBlock finds the first row of block that is not '<Name>;<Temp>[;<Timestamp>]'.
+// It is slow and meant to explain why the fast parsers failed on a block.
+func ValidateBlock(block []byte) error {
+	for row := 1; len(block) > 0; row++ {
+		line, rest, ok := bytes.Cut(block, []byte{'\n'})
+		if !ok {
+			return fmt.Errorf("row %d '%s': missing '\\n'", row, line)
+		}
+		block = rest
+
+		name, temp, ok := bytes.Cut(line, []byte{';'})
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("row %d '%s': missing '<Name>;'", row, line)
+		}
+		temp, _, _ = bytes.Cut(temp, []byte{';'})
+		temp = bytes.TrimPrefix(temp, []byte{'-'})
+		if n := len(temp); n < 3 || n > 4 || temp[n-2] != '.' || !isDigits(temp[:n-2]) || !isDigits(temp[n-1:]) {
+			return fmt.Errorf("row %d '%s': temperature is not -?\\d?\\d.\\d", row, line)
+		}
+	}
+	return nil
+}
+
+func isDigits(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(b) > 0
+}
@@ -0,0 +1,129 @@
+package pkg
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	SWAR_ONES  = 0x0101010101010101
+	SWAR_HIGHS = 0x8080808080808080
+	SWAR_SEMIS = ';' * SWAR_ONES
+)
+
+// ParseBlockSWAR is ParseBlock finding ';' 8 bytes at a time and decoding temperatures without branches.
+// Rows too close to the end of block for an 8 byte read are left to ParseBlock.
+func ParseBlockSWAR(block []byte, out []HKV, hash Hasher) ([]HKV, int, error) {
+	return parseBlockSWAR(block, out, hash, false)
+}
+
+// ParseBlockSWARWord is ParseBlockSWAR keying rows by HashWord, which hash must be.
+func ParseBlockSWARWord(block []byte, out []HKV, hash Hasher) ([]HKV, int, error) {
+	return parseBlockSWAR(block, out, hash, true)
+}
+
+func parseBlockSWAR(block []byte, out []HKV, hash Hasher, word bool) ([]HKV, int, error) {
+	i := 0
+	for i < len(block) && len(out) < cap(out) {
+		start := i
+		var h HashKey
+		if word {
+			i, h = semicolonWord(block, i)
+		} else {
+			i = semicolon(block, i)
+		}
+		key := block[start:i]
+		i++
+		if i+8 > len(block) {
+			var n int
+			var err error
+			out, n, err = ParseBlock(block[start:], out, hash)
+			return out, start + n, err
+		}
+
+		val, n, ok := decodeTemp(binary.LittleEndian.Uint64(block[i:]))
+		if !ok {
+			return out, i, ErrMalformed
+		}
+		if !word {
+			h = hash(key)
+		}
+		out = append(out, HKV{HK: HK{Hash: h, Key: key}, Value: val})
+		i = skipRow(block, i+n)
+	}
+	return out, i, nil
+}
+
+// semicolon returns the index of the first ';' in block at or after i.
+func semicolon(block []byte, i int) int {
+	for ; i+8 <= len(block); i += 8 {
+		// the lowest set high bit marks the first ';', the ones above it may be borrows
+		x := binary.LittleEndian.Uint64(block[i:]) ^ SWAR_SEMIS
+		if m := (x - SWAR_ONES) &^ x & SWAR_HIGHS; m != 0 {
+			return i + bits.TrailingZeros64(m)>>3
+		}
+	}
+	for ; block[i] != ';'; i++ {
+	}
+	return i
+}
+
+// semicolonWord is semicolon also returning HashWord of block[i:end], from the first and last word it loads.
+func semicolonWord(block []byte, i int) (end int, h HashKey) {
+	start := i
+	var first, prev uint64
+	for ; i+8 <= len(block); i += 8 {
+		word := binary.LittleEndian.Uint64(block[i:])
+		x := word ^ SWAR_SEMIS
+		if m := (x - SWAR_ONES) &^ x & SWAR_HIGHS; m != 0 {
+			k := bits.TrailingZeros64(m) &^ 7 // bits of the name in word
+			end = i + k>>3
+			if i == start {
+				first = word & (1<<k - 1)
+				return end, wordHash(first, first, end-start)
+			}
+			// the last 8 bytes end in word, a shift by 64 is 0 when word holds none of them
+			return end, wordHash(first, prev>>k|word<<(64-k), end-start)
+		}
+		if i == start {
+			first = word
+		}
+		prev = word
+	}
+	end = semicolon(block, i)
+	return end, HashWord(block[start:end])
+}
+
+// skipRow returns the index after the '\n' ending the row at i, anything after the temperature is skipped
+// as ParseBlock does.
+func skipRow(block []byte, i int) int {
+	for ; block[i] != '\n'; i++ {
+	}
+	return i + 1
+}
+
+// decodeTemp decodes the '-?\d?\d\.\d' temperature in the low bytes of a little endian word, returning
+// it in tenths and its length. ok is false if the word does not start with one, the bytes after it are not looked at.
+//
+// The '.' is the first of bytes 1-3 without bit 4 set, which no digit has. Shifting by its position aligns
+// the number so its digits can be combined by a single multiplication.
+func decodeTemp(word uint64) (val int, n int, ok bool) {
+	dot := bits.TrailingZeros64(^word & 0x10101000) // 12, 20 or 28, 64 without '.'
+	shift := (28 - dot) & 63
+	signed := int64(^word<<59) >> 63 // -1 on a leading '-'
+	aligned := (word &^ uint64(signed&0xFF)) << shift
+
+	// now '\0' or tens at byte 1, ones at 2, '.' at 3, tenths at 4
+	digits := aligned & 0x0F000F0F00
+	abs := int64(((digits * 0x640a0001) >> 32) & 0x3FF)
+	val = int((abs ^ signed) - signed)
+	n = dot>>3 + 2
+
+	high := aligned & 0xF000F0F000
+	ok = dot <= 20+int(signed&8) && // only a '-' leaves room for the '.' at byte 3
+		(high == 0x3000303000 || (high == 0x3000300000 && aligned&0xFF00 == 0)) &&
+		(digits+0x0600060600)&0x1000101000 == 0 &&
+		(aligned>>24)&0xFF == '.' &&
+		(signed == 0 || word&0xFF == '-')
+	return val, n, ok
+}
@@ -0,0 +1,28 @@
+package pkg
+
+import "testing"
+
+// TestParseBlock checks the sign and every digit of a temperature, with one and two digits before the '.'.
+func TestParseBlock(t *testing.T) {
+	block := []byte("A;1.0\nB;-2.5\nC;12.3\nD;-99.9\nE;0.0\nF;-0.1\n")
+	want := []HKV{
+		{HK: HK{Key: []byte("A")}, Value: 10},
+		{HK: HK{Key: []byte("B")}, Value: -25},
+		{HK: HK{Key: []byte("C")}, Value: 123},
+		{HK: HK{Key: []byte("D")}, Value: -999},
+		{HK: HK{Key: []byte("E")}, Value: 0},
+		{HK: HK{Key: []byte("F")}, Value: -1},
+	}
+	rows, n, err := ParseBlock(block, make([]HKV, 0, len(want)), HashXXH3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(block) || len(rows) != len(want) {
+		t.Fatalf("parsed %d rows of %d bytes, want %d rows of %d bytes", len(rows), n, len(want), len(block))
+	}
+	for i, row := range rows {
+		if string(row.Key) != string(want[i].Key) || row.Value != want[i].Value {
+			t.Errorf("row %d is %s=%d, want %s=%d", i, row.Key, row.Value, want[i].Key, want[i].Value)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package pkg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+const (
+	PARSER_SCALAR = "scalar" // ParseBlock
+	PARSER_SWAR   = "swar"   // ParseBlockSWAR
+	PARSER_SIMD   = "simd"   // ParseBlockSIMD
+)
+
+// ErrParserMismatch is returned by a cross-checking Parser when a parser disagrees with ParseBlock.
+var ErrParserMismatch = errors.New("parser mismatch")
+
+// Parser appends the rows of a line aligned block to out until out is full, see ParseBlock.
+type Parser interface {
+	Parse(block []byte, out []HKV) ([]HKV, int, error)
+}
+
+// ParserFunc is a parse function keying rows by a Hasher, see ParseBlock.
+type ParserFunc func(block []byte, out []HKV, hash Hasher) ([]HKV, int, error)
+
+// PARSERS are the parsers selectable by name.
+var PARSERS = map[string]ParserFunc{
+	PARSER_SCALAR: ParseBlock,
+	PARSER_SWAR:   ParseBlockSWAR,
+	PARSER_SIMD:   ParseBlockSIMD,
+}
+
+// hashedParser is a ParserFunc bound to its Hasher.
+type hashedParser struct {
+	parse ParserFunc
+	hash  Hasher
+}
+
+func (p hashedParser) Parse(block []byte, out []HKV) ([]HKV, int, error) {
+	return p.parse(block, out, p.hash)
+}
+
+// WORD_PARSERS replace PARSERS with HASH_WORD, building HashWord from the words they load looking for ';'
+// instead of calling it.
+var WORD_PARSERS = map[string]ParserFunc{
+	PARSER_SWAR: ParseBlockSWARWord,
+	PARSER_SIMD: ParseBlockSIMDWord,
+}
+
+// NewParser returns the named parser keying rows by the named hash, cross-checked against the scalar ParseBlock
+// if check is set.
+func NewParser(name, hashName string, check bool) (Parser, error) {
+	parse, ok := PARSERS[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown parser '%s'", name)
+	}
+	hash, err := NewHasher(hashName)
+	if err != nil {
+		return nil, err
+	}
+	if w, ok := WORD_PARSERS[name]; ok && hashName == HASH_WORD {
+		parse = w
+	}
+	var p Parser = hashedParser{parse: parse, hash: hash}
+	if check {
+		p = checkedParser{name: name, p: p, hash: hash}
+	}
+	return p, nil
+}
+
+// checkedParser runs ParseBlock next to p on every block and fails on any difference.
+// It is as slow as both together and meant to validate a fast parser on real data.
+// The simd parser's findDelims is also compared with the generic one on every window.
+type checkedParser struct {
+	name string
+	p    Parser
+	hash Hasher
+}
+
+func (c checkedParser) Parse(block []byte, out []HKV) ([]HKV, int, error) {
+	if c.name == PARSER_SIMD {
+		if err := CheckDelims(block); err != nil {
+			return out, 0, err
+		}
+	}
+	from := len(out)
+	out, n, err := c.p.Parse(block, out)
+	want, wantN, wantErr := ParseBlock(block, make([]HKV, 0, cap(out)-from), c.hash)
+	if (err == nil) != (wantErr == nil) {
+		return out, n, fmt.Errorf("%w: %s returned error %v, scalar %v", ErrParserMismatch, c.name, err, wantErr)
+	}
+	if err != nil {
+		return out, n, err
+	}
+
+	got := out[from:]
+	if n != wantN || len(got) != len(want) {
+		return out, n, fmt.Errorf("%w: %s parsed %d rows of %d bytes, scalar %d rows of %d bytes",
+			ErrParserMismatch, c.name, len(got), n, len(want), wantN)
+	}
+	for i := range got {
+		if got[i].Hash != want[i].Hash || got[i].Value != want[i].Value || !bytes.Equal(got[i].Key, want[i].Key) {
+			return out, n, fmt.Errorf("%w: %s parsed row %d as '%s'=%d, scalar as '%s'=%d",
+				ErrParserMismatch, c.name, i+1, got[i].Key, got[i].Value, want[i].Key, want[i].Value)
+		}
+	}
+	return out, n, nil
+}
@@ -0,0 +1,146 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// TestDecodeTemp decodes every temperature from -99.9 to 99.9, followed by a '\n' or anything else,
+// and checks that breaking any of its bytes is noticed.
+func TestDecodeTemp(t *testing.T) {
+	for v := -999; v <= 999; v++ {
+		temp := PrintIndec(v)
+		for _, tail := range []string{"\n", ";1700000000\n", "7\n", "\x00\xff\xff\xff\xff"} {
+			var word [8]byte
+			copy(word[copy(word[:], temp):], tail)
+			val, n, ok := decodeTemp(binary.LittleEndian.Uint64(word[:]))
+			if !ok || val != v || n != len(temp) {
+				t.Fatalf("decodeTemp(%q) = %d, %d, %v, want %d, %d, true", word, val, n, ok, v, len(temp))
+			}
+		}
+
+		for i := range temp {
+			for _, c := range []byte{'/', ':', '.', ';', '\n', 'a', 0x80} {
+				if c == temp[i] {
+					continue
+				}
+				var word [8]byte
+				copy(word[:], temp)
+				word[i] = c
+				word[len(temp)] = '\n'
+				if _, _, ok := decodeTemp(binary.LittleEndian.Uint64(word[:])); ok {
+					t.Fatalf("decodeTemp(%q) accepted a broken %q", word, temp)
+				}
+			}
+		}
+	}
+}
+
+// parseResult is what a parser returned on a block, or that it panicked.
+type parseResult struct {
+	rows     []HKV
+	n        int
+	err      error
+	panicked bool
+}
+
+func parseWith(p Parser, block []byte, size int) (r parseResult) {
+	defer func() {
+		if recover() != nil {
+			r.panicked = true
+		}
+	}()
+	r.rows, r.n, r.err = p.Parse(block, make([]HKV, 0, size))
+	return r
+}
+
+func newParser(t *testing.T, name, hash string) Parser {
+	p, err := NewParser(name, hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func (r parseResult) ok() bool {
+	return r.err == nil && !r.panicked
+}
+
+func (r parseResult) equal(o parseResult) bool {
+	if r.n != o.n || len(r.rows) != len(o.rows) {
+		return false
+	}
+	for i := range r.rows {
+		if r.rows[i].Hash != o.rows[i].Hash || r.rows[i].Value != o.rows[i].Value || !bytes.Equal(r.rows[i].Key, o.rows[i].Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// FuzzParsers compares ParseBlockSWAR and ParseBlockSIMD with ParseBlock, also keying rows by HashWord. On a block
+// ValidateBlock accepts all of them must parse the same rows, elsewhere the fast parsers may reject rows ParseBlock
+// takes, but whatever they parse without an error must be what ParseBlock parses.
+func FuzzParsers(f *testing.F) {
+	for _, seed := range []string{
+		"A;1.0\nB;-2.5\nC;99.9\nD;-99.9\n",
+		"Hamburg;12.0\nBulawayo;8.9\nPalembang;38.8\nSt. John's;15.2\nCracow;12.6\n",
+		"A;1.0;12.3\nB;2.0;45.6\n",
+		"A;1.0;2024-01-01T00:00:00Z\nB;-2.0;1700000000\n",
+		"A;1.23\nB;12.3\n",
+		"A;123.4\nB;1.0\n",
+		"A;.5\nB;-.5\n",
+		"A;1,0\nB;1.0\n",
+		"A\nB;1.0\n",
+		"Ærø;-0.1\nZürich;-10.0\nSão Paulo;25.3\n",
+		"A station name that is longer than the window;1.0\nB;2.0\n",
+		"A;1.0\nB;2.0\nC;3.0\nD;4.0\nE;5.0\nF;6.0\nG;7.0\nH;8.0\nI;9.0\n",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, block []byte) {
+		valid := ValidateBlock(block) == nil
+		for _, hash := range []string{HASH_XXH3, HASH_WORD} {
+			for _, size := range []int{len(block) + 1, 3} {
+				want := parseWith(newParser(t, PARSER_SCALAR, hash), block, size)
+				if valid && !want.ok() {
+					t.Fatalf("scalar failed on a valid block (panic %v): %v", want.panicked, want.err)
+				}
+				for _, name := range []string{PARSER_SWAR, PARSER_SIMD} {
+					got := parseWith(newParser(t, name, hash), block, size)
+					if valid && !got.ok() {
+						t.Fatalf("%s %s failed on a valid block (panic %v): %v", name, hash, got.panicked, got.err)
+					}
+					if got.ok() && !(want.ok() && got.equal(want)) {
+						t.Fatalf("%s %s parsed %d rows of %d bytes, scalar %d rows of %d bytes (err %v, panic %v)",
+							name, hash, len(got.rows), got.n, len(want.rows), want.n, want.err, want.panicked)
+					}
+				}
+			}
+		}
+	})
+}
+
+// TestWordHash checks the HashWord the swar and simd parsers build while scanning against HashWord itself,
+// for names of every length up to a few words at every alignment.
+func TestWordHash(t *testing.T) {
+	for n := 0; n <= 40; n++ {
+		for off := 0; off < 8; off++ {
+			block := bytes.Repeat([]byte{'x'}, off)
+			for i := range n {
+				block = append(block, byte('A'+i))
+			}
+			block = append(block, ";12.3\n\xff\xff\xff\xff\xff\xff\xff\xff"...)
+			key := block[off : off+n]
+			want := HashWord(key)
+			if end, h := semicolonWord(block, off); end != off+n || h != want {
+				t.Fatalf("semicolonWord of %q is %d, %x, want %d, %x", key, end, h, off+n, want)
+			}
+			if h := loadWordHash(block, off, n); h != want {
+				t.Fatalf("loadWordHash of %q is %x, want %x", key, h, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"os"
+	"slices"
+)
+
+const (
+	PERFECT_BUCKET = 4       // average stations per bucket
+	PERFECT_TRIES  = 1 << 24 // seeds tried per bucket before giving up
+)
+
+// PerfectHash is a minimal perfect hash over a known set of stations, built in two phases: the stations are
+// bucketed by HK.Hash, then every bucket, largest first, gets a seed that moves all its stations to free slots.
+// Index maps a row to its slot with one seed lookup and one mix, and compares the key to tell unknown stations.
+type PerfectHash struct {
+	keys  []HK     // the station of each slot
+	seeds []uint32 // per bucket
+
+	Collided [][]byte // names sharing their hash with another, no seed tells them apart so they are left to the general table
+}
+
+// NewPerfectHash builds a PerfectHash over names keyed by hash, duplicate names are dropped.
+// Distinct names with the same hash are not in it, see Collided.
+func NewPerfectHash(names [][]byte, hash Hasher) (*PerfectHash, error) {
+	byHash := make(map[HashKey][][]byte, len(names))
+	var hashes []HashKey
+	for _, name := range names {
+		h := hash(name)
+		same, ok := byHash[h]
+		if !ok {
+			hashes = append(hashes, h)
+		}
+		if !slices.ContainsFunc(same, func(other []byte) bool { return bytes.Equal(other, name) }) {
+			byHash[h] = append(same, name)
+		}
+	}
+	keys := make([]HK, 0, len(hashes))
+	var collided [][]byte
+	for _, h := range hashes {
+		if same := byHash[h]; len(same) > 1 {
+			collided = append(collided, same...)
+		} else {
+			keys = append(keys, HK{Hash: h, Key: same[0]})
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("perfect hash: no stations")
+	}
+
+	p := &PerfectHash{keys: make([]HK, len(keys)), seeds: make([]uint32, len(keys)/PERFECT_BUCKET+1), Collided: collided}
+	buckets := make([][]int, len(p.seeds))
+	for i := range keys {
+		b := p.bucket(keys[i].Hash)
+		buckets[b] = append(buckets[b], i)
+	}
+	order := make([]int, len(buckets))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return len(buckets[b]) - len(buckets[a]) })
+
+	taken := make([]bool, len(keys))
+	var slots []int
+	for _, b := range order {
+		if len(buckets[b]) == 0 {
+			break
+		}
+	search:
+		for seed := uint32(0); ; seed++ {
+			if seed == PERFECT_TRIES {
+				return nil, fmt.Errorf("perfect hash: no seed found for a bucket of %d stations", len(buckets[b]))
+			}
+			slots = slots[:0]
+			for _, k := range buckets[b] {
+				s := p.slot(keys[k].Hash, seed)
+				if taken[s] || slices.Contains(slots, s) {
+					continue search
+				}
+				slots = append(slots, s)
+			}
+			p.seeds[b] = seed
+			for j, s := range slots {
+				taken[s] = true
+				p.keys[s] = keys[buckets[b][j]]
+			}
+			break
+		}
+	}
+	return p, nil
+}
+
+// LoadStations reads the station names of a file, one per line: the part before the first ';' of
+// 'weather_stations.csv' rows and measurements, or before the last '=' of text and partial outputs.
+// Empty and '#' lines are skipped. The names point into the file's contents.
+func LoadStations(name string) ([][]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var names [][]byte
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if i := bytes.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		} else if i := bytes.LastIndexByte(line, '='); i >= 0 {
+			line = line[:i]
+		}
+		names = append(names, line)
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("load stations '%s': no stations", name)
+	}
+	return names, nil
+}
+
+func (p *PerfectHash) Len() int {
+	return len(p.keys)
+}
+
+func (p *PerfectHash) bucket(hash HashKey) int {
+	return int(uint64(hash) % uint64(len(p.seeds)))
+}
+
+// slot mixes hash with seed and maps it onto [0, Len()) with a multiplication instead of a modulo.
+func (p *PerfectHash) slot(hash HashKey, seed uint32) int {
+	x := uint64(hash) ^ uint64(seed)*0x9E3779B97F4A7C15
+	x = (x ^ x>>30) * 0xBF58476D1CE4E5B9
+	x = (x ^ x>>27) * 0x94D049BB133111EB
+	x ^= x >> 31
+	s, _ := bits.Mul64(x, uint64(len(p.keys)))
+	return int(s)
+}
+
+// Index returns the slot of hk, -1 if it is not one of the stations.
+func (p *PerfectHash) Index(hk *HK) int {
+	s := p.slot(hk.Hash, p.seeds[p.bucket(hk.Hash)])
+	if !p.keys[s].Equal(hk) {
+		return -1
+	}
+	return s
+}
+
+// PerfectMap aggregates the rows of the stations of a PerfectHash into a dense array indexed by their slot.
+type PerfectMap struct {
+	ph    *PerfectHash
+	slots []CityData // Count == 0 marks a station without rows yet
+}
+
+// NewMap returns an empty PerfectMap, one per worker.
+func (p *PerfectHash) NewMap() *PerfectMap {
+	m := &PerfectMap{ph: p, slots: make([]CityData, len(p.keys))}
+	for i := range m.slots {
+		m.slots[i].HK = p.keys[i]
+	}
+	return m
+}
+
+// AddBatch aggregates the rows of known stations and returns the others, moved to the front of batch,
+// for a general table to take.
+func (m *PerfectMap) AddBatch(batch []HKV) []HKV {
+	unknown := batch[:0]
+	for i := range batch {
+		s := m.ph.Index(&batch[i].HK)
+		if s < 0 {
+			unknown = append(unknown, batch[i])
+			continue
+		}
+		cd := &m.slots[s]
+		val := batch[i].Value
+		if cd.Count == 0 {
+			cd.Min, cd.Max = val, val
+		}
+		cd.Min = min(cd.Min, val)
+		cd.Max = max(cd.Max, val)
+		cd.Sum += val
+		cd.Count++
+	}
+	return unknown
+}
+
+// Each calls fn for every station with rows, fn may modify the CityData in place.
+func (m *PerfectMap) Each(fn func(cd *CityData)) {
+	for i := range m.slots {
+		if m.slots[i].Count != 0 {
+			fn(&m.slots[i])
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func testStations(n int) [][]byte {
+	names := make([][]byte, n)
+	for i := range names {
+		names[i] = fmt.Appendf(nil, "Station %d", i)
+	}
+	return names
+}
+
+// TestPerfectHash checks that every station gets a slot of its own and that unknown stations get none.
+func TestPerfectHash(t *testing.T) {
+	names := testStations(10_000)
+	p, err := NewPerfectHash(append(names, names[:10]...), HashXXH3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != len(names) || len(p.Collided) != 0 {
+		t.Fatalf("%d slots and %d collided names, want %d and 0", p.Len(), len(p.Collided), len(names))
+	}
+	taken := make([]bool, p.Len())
+	for _, name := range names {
+		s := p.Index(&HK{Hash: HashXXH3(name), Key: name})
+		if s < 0 || taken[s] {
+			t.Fatalf("'%s' has slot %d, taken %v", name, s, s >= 0 && taken[s])
+		}
+		taken[s] = true
+	}
+	for _, name := range []string{"Unknown", "Station -1", "Station 10000", ""} {
+		if s := p.Index(&HK{Hash: HashXXH3([]byte(name)), Key: []byte(name)}); s >= 0 {
+			t.Errorf("unknown '%s' has slot %d", name, s)
+		}
+	}
+}
+
+// TestPerfectHashCollided checks that names sharing a hash are left out, and that a PerfectMap hands their rows
+// to the general table with those of unknown stations.
+func TestPerfectHashCollided(t *testing.T) {
+	hash := func(key []byte) HashKey {
+		if bytes.HasPrefix(key, []byte("Twin")) {
+			return 42
+		}
+		return HashXXH3(key)
+	}
+	names := append(testStations(100), []byte("Twin A"), []byte("Twin B"), []byte("Twin A"))
+	p, err := NewPerfectHash(names, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 100 || len(p.Collided) != 2 {
+		t.Fatalf("%d slots and collided %q, want 100 and the twins", p.Len(), p.Collided)
+	}
+
+	var batch []HKV
+	for _, name := range [][]byte{[]byte("Twin A"), names[0], []byte("Twin B"), []byte("Unknown"), names[1]} {
+		batch = append(batch, HKV{HK: HK{Hash: hash(name), Key: name}, Value: 10})
+	}
+	m := p.NewMap()
+	rest := m.AddBatch(batch)
+	if len(rest) != 3 || string(rest[0].Key) != "Twin A" || string(rest[1].Key) != "Twin B" || string(rest[2].Key) != "Unknown" {
+		t.Fatalf("AddBatch left %v, want the twins and the unknown station", rest)
+	}
+	var counted int
+	m.Each(func(cd *CityData) {
+		counted += cd.Count
+	})
+	if counted != 2 {
+		t.Errorf("the PerfectMap has %d rows, want 2", counted)
+	}
+}
@@ -0,0 +1,124 @@
+package pkg
+
+import (
+	"os"
+	"sync"
+	"unsafe"
+)
+
+// RELEASE_CHUNK is how much processed data a Releaser collects before dropping it, to keep syscalls rare.
+const RELEASE_CHUNK = 64 << 20
+
+// Releaser drops the pages of a mapped region from memory once every block before them has been processed,
+// so a file larger than RAM is aggregated with bounded RSS. Workers finish blocks out of order, so it tracks
+// the end of every processed block and releases up to the first one still being worked on.
+type Releaser struct {
+	region []byte
+
+	mu       sync.Mutex
+	ends     map[int]int // end of every processed block past frontier, by its start
+	frontier int         // region[:frontier] is processed
+	released int         // the whole pages from the region's first page boundary up to it are released
+	Released int64       // bytes released so far
+}
+
+// NewReleaser tracks region, which ReadFile splits into blocks from its start.
+func NewReleaser(region []byte) *Releaser {
+	r := &Releaser{region: region, ends: map[int]int{}}
+	if len(region) > 0 {
+		page := uintptr(os.Getpagesize())
+		r.released = int((page - uintptr(unsafe.Pointer(&region[0]))%page) % page)
+	}
+	return r
+}
+
+// Done marks a block of the region processed. Releasing is advisory, errors only leave the pages in memory.
+// Blocks outside the region, like the copy ReadFile makes of a last line without '\n', are ignored.
+func (r *Releaser) Done(block []byte) {
+	if len(block) == 0 {
+		return
+	}
+	start := int(uintptr(unsafe.Pointer(&block[0])) - uintptr(unsafe.Pointer(&r.region[0])))
+	if start < 0 || start >= len(r.region) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ends[start] = start + len(block)
+	for {
+		end, ok := r.ends[r.frontier]
+		if !ok {
+			break
+		}
+		delete(r.ends, r.frontier)
+		r.frontier = end
+	}
+
+	if r.frontier-r.released < RELEASE_CHUNK && r.frontier < len(r.region) {
+		return
+	}
+	page := os.Getpagesize()
+	to := r.released + (r.frontier-r.released)/page*page
+	if to <= r.released {
+		return
+	}
+	if MRelease(r.region[r.released:to]) == nil {
+		r.Released += int64(to - r.released)
+	}
+	r.released = to
+}
+
+// BlockPool recycles the buffers a stream is read into: a worker puts a block back once it asks for the next one,
+// so reading allocates a buffer only while all of them are still being worked on.
+type BlockPool struct {
+	size int
+	pool sync.Pool
+}
+
+// NewBlockPool returns a pool of buffers of size bytes.
+func NewBlockPool(size int) *BlockPool {
+	return &BlockPool{size: size}
+}
+
+// Get returns an empty buffer of the pool's size.
+func (p *BlockPool) Get() []byte {
+	if buf, ok := p.pool.Get().(*[]byte); ok {
+		return (*buf)[:0]
+	}
+	return make([]byte, 0, p.size)
+}
+
+// Done puts the buffer of a processed block back, blocks not starting a buffer of the pool's size are dropped.
+func (p *BlockPool) Done(block []byte) {
+	if cap(block) != p.size {
+		return
+	}
+	block = block[:0]
+	p.pool.Put(&block)
+}
+
+// KeyCache copies the keys of parsed rows out of their block, for the pipelines whose batches outlive it: a
+// block is done once it is parsed, and released or reused while its rows may still wait in a channel.
+// Every distinct key is looked up in the run's Interner once.
+// A KeyCache is not safe for concurrent use, every parse worker has its own.
+type KeyCache struct {
+	interner *Interner
+	keys     map[string][]byte
+}
+
+func NewKeyCache(interner *Interner) *KeyCache {
+	return &KeyCache{interner: interner, keys: map[string][]byte{}}
+}
+
+// Copy points the keys of batch to their interned copies.
+func (c *KeyCache) Copy(batch []HKV) {
+	for i := range batch {
+		key, ok := c.keys[string(batch[i].Key)]
+		if !ok {
+			key = c.interner.Intern(batch[i].Hash, batch[i].Key)
+			c.keys[string(key)] = key
+		}
+		batch[i].Key = key
+	}
+}
@@ -0,0 +1,12 @@
+package pkg
+
+import "syscall"
+
+// ReadRusage returns the peak resident set in bytes and the page faults of the process so far.
+func ReadRusage() (peakRSS, faults int64, err error) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0, err
+	}
+	return ru.Maxrss * 1024, ru.Minflt + ru.Majflt, nil
+}
@@ -0,0 +1,36 @@
+package pkg
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// PROCESS_MEMORY_COUNTERS of psapi.h.
+type processMemoryCounters struct {
+	cb                         uint32
+	PageFaultCount             uint32
+	PeakWorkingSetSize         uintptr
+	WorkingSetSize             uintptr
+	QuotaPeakPagedPoolUsage    uintptr
+	QuotaPagedPoolUsage        uintptr
+	QuotaPeakNonPagedPoolUsage uintptr
+	QuotaNonPagedPoolUsage     uintptr
+	PagefileUsage              uintptr
+	PeakPagefileUsage          uintptr
+}
+
+var procGetProcessMemoryInfo = syscall.NewLazyDLL("psapi.dll").NewProc("GetProcessMemoryInfo")
+
+// ReadRusage returns the peak working set in bytes and the page faults of the process so far.
+func ReadRusage() (peakRSS, faults int64, err error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0, err
+	}
+	var c processMemoryCounters
+	c.cb = uint32(unsafe.Sizeof(c))
+	if r, _, err := procGetProcessMemoryInfo.Call(uintptr(process), uintptr(unsafe.Pointer(&c)), uintptr(c.cb)); r == 0 {
+		return 0, 0, err
+	}
+	return int64(c.PeakWorkingSetSize), int64(c.PageFaultCount), nil
+}
@@ -24,6 +24,31 @@ func (a *AtomicDuration) Duration() time.Duration {
 	return time.Duration(atomic.LoadInt64((*int64)(a)))
 }
 
+// TWorker splits the time of a block worker into busy, working on blocks, and idle, waiting for the next one.
+type TWorker struct {
+	last       time.Time
+	prev       []byte
+	Busy, Idle time.Duration
+
+	Done func(block []byte) // if set, called with every block once the worker asks for the next
+}
+
+// Recv waits for the next block of ch, counting the time since the previous one as busy and the wait as idle.
+func (w *TWorker) Recv(ch chan []byte) ([]byte, bool) {
+	now := time.Now()
+	if !w.last.IsZero() {
+		w.Busy += now.Sub(w.last)
+	}
+	if w.Done != nil && w.prev != nil {
+		w.Done(w.prev)
+	}
+	block, ok := <-ch
+	w.prev = block
+	w.last = time.Now()
+	w.Idle += w.last.Sub(now)
+	return block, ok
+}
+
 type TEvent struct {
 	Time time.Time
 	Text string
@@ -36,6 +61,7 @@ func (e TEvent) String() string {
 type Timings struct {
 	Start       time.Time
 	Since_Setup time.Duration
+	Workers     int // goroutines per stage, per worker sums are averaged over them
 
 	// ReadFile         time.Time
 	Since_ReadFile   time.Duration
@@ -44,9 +70,10 @@ type Timings struct {
 
 	ParseBlocks       time.Time
 	Since_ParseBlock  time.Duration
-	SendBatches       time.Time
 	Since_SendBatches AtomicDuration
 	Since_WaitParse   time.Duration
+	PerWorker         []TWorker      // one per block worker, each only touches its own
+	Since_Route       AtomicDuration // PIPELINE_PARTITIONED: splitting batches by shard, summed over workers
 
 	MapData       time.Time
 	Since_MapData time.Duration
@@ -57,20 +84,63 @@ type Timings struct {
 	Since_Merge     time.Duration
 	Since_MergeWait time.Duration
 	Since_Sort      time.Duration
+	Since_KMerge    time.Duration // PIPELINE_PARTITIONED: merging the sorted shards, which replaces Merge
 	Since_Build     time.Duration
 	Since_Print     time.Duration
 
+	PeakRSS    int64 // bytes, read by Report
+	PageFaults int64
+	Released   int64 // bytes of the mapping dropped by a Releaser
+
+	Normalize     string // Config.Normalize
+	Merged        int    // spellings a Normalizer merged into another one of their station
+	RewrittenRows int64  // rows whose name it rewrote
+
 	Events    []TEvent
 	ChanEvent chan TEvent
 }
 
+// SendEvent records an event, Timings without a ChanEvent drop them.
 func (t *Timings) SendEvent(tNow time.Time, text string) {
+	if t.ChanEvent == nil {
+		return
+	}
 	t.ChanEvent <- TEvent{Time: tNow, Text: text}
 }
 
-const (
-	CHANS = 11
-)
+// TPhase is a named top level duration of a run.
+type TPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Phases lists the top level durations of a finished run in pipeline order, ending with the total.
+// A partitioned run has its own: routing rows to shards, aggregating (map) and sorting in them, and the k-way merge.
+func (t *Timings) Phases() []TPhase {
+	if t.Since_KMerge > 0 {
+		return []TPhase{
+			{"read", t.Since_ReadFile},
+			{"parse", t.Since_ParseBlock},
+			{"route", t.Since_Route.Duration() / time.Duration(max(1, t.Workers))},
+			{"map", t.Since_MapData},
+			{"sort", t.Since_Sort},
+			{"kmerge", t.Since_KMerge},
+			{"build", t.Since_Build},
+			{"print", t.Since_Print},
+			{"total", time.Since(t.Start)},
+		}
+	}
+	return []TPhase{
+		{"read", t.Since_ReadFile},
+		{"parse", t.Since_ParseBlock},
+		{"map", t.Since_MapData},
+		{"merge", t.Since_Merge},
+		{"sort", t.Since_Sort},
+		{"build", t.Since_Build},
+		{"print", t.Since_Print},
+		{"total", time.Since(t.Start)},
+	}
+}
 
 func (t Timings) Report() {
 	close(t.ChanEvent)
@@ -89,12 +159,15 @@ func (t Timings) Report() {
 
 	Plot(t.Events)
 
+	t.PeakRSS, t.PageFaults, _ = ReadRusage()
+
 	log.Printf(`
 ? Setup: %v
 [ Read: %v
   > Send: %v
 [ Parse: %v
   > Send: %v
+  > Route: %v
   > Wait: %v
 [ MapData: %v
   > Send: %v
@@ -102,9 +175,11 @@ func (t Timings) Report() {
 ! Merge: %v
   > Wait: %v
 ! Sort: %v
+! K-Merge: %v
 ! Build: %v
 ! Print: %v
 = Total: %v
+# Peak RSS: %d MiB, page faults: %d, released: %d MiB
 		 `,
 		t.Since_Setup,
 
@@ -112,7 +187,8 @@ func (t Timings) Report() {
 		t.Since_SendBlocks,
 
 		t.Since_ParseBlock,
-		t.Since_SendBatches.Duration()/CHANS,
+		t.Since_SendBatches.Duration()/time.Duration(max(1, t.Workers)),
+		t.Since_Route.Duration()/time.Duration(max(1, t.Workers)),
 		t.Since_WaitParse,
 
 		t.Since_MapData,
@@ -123,8 +199,16 @@ func (t Timings) Report() {
 		t.Since_MergeWait-t.Since_Merge,
 
 		t.Since_Sort,
+		t.Since_KMerge,
 		t.Since_Build,
 		t.Since_Print,
 		time.Since(t.Start),
+		t.PeakRSS>>20, t.PageFaults, t.Released>>20,
 	)
+	if t.Normalize != "" {
+		log.Printf("normalize %s: merged %d spellings into another one of their station, rewrote %d rows", t.Normalize, t.Merged, t.RewrittenRows)
+	}
+	for i, w := range t.PerWorker {
+		log.Printf("worker %d: busy %v, idle %v", i, w.Busy, w.Idle)
+	}
 }